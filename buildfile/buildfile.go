@@ -0,0 +1,292 @@
+// Package buildfile is a lossless editor for Please BUILD files.
+//
+// Files are parsed with the buildtools parser, but only the top level function calls
+// (rules) are picked out of the result. Everything else is kept verbatim, so a file can
+// be parsed, have a few rules swapped out, and be written back without disturbing any
+// hand written content, which reformatting the whole syntax tree would.
+package buildfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// File is a parsed BUILD file, represented as an ordered list of statements.
+type File struct {
+	Path  string
+	Stmts []*Stmt
+}
+
+// Stmt is a chunk of a BUILD file. If the chunk is a top level function call,
+// Rule is set, otherwise it is just text we don't care about (comments, blank lines
+// or any other statement).
+type Stmt struct {
+	Raw  string
+	Rule *Rule
+}
+
+// Rule is a top level function call, such as go_module(...).
+type Rule struct {
+	Kind string
+
+	rule *build.Rule
+	stmt *Stmt
+}
+
+// Name returns the name argument of the rule.
+func (r *Rule) Name() string {
+	return r.AttrString("name")
+}
+
+// AttrString returns the value of a string argument, or an empty string if the
+// argument was not set or is not a plain string.
+func (r *Rule) AttrString(key string) string {
+	return r.rule.AttrString(key)
+}
+
+// AttrStrings returns the value of a list of strings argument, or nil if the
+// argument was not set or is not a plain list of strings.
+func (r *Rule) AttrStrings(key string) []string {
+	return r.rule.AttrStrings(key)
+}
+
+// AttrKeys returns the names of the keyword arguments of the rule, in the order they're in.
+func (r *Rule) AttrKeys() []string {
+	return r.rule.AttrKeys()
+}
+
+// Attr returns the syntax tree of an argument, or nil if the argument was not set.
+func (r *Rule) Attr(key string) build.Expr {
+	return r.rule.Attr(key)
+}
+
+// Walk calls fn with the path of every BUILD file under root, skipping plz-out and any hidden
+// directories.
+func Walk(root string, fn func(path string) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && (info.Name() == "plz-out" || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != "BUILD" && info.Name() != "BUILD.plz" {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// Strings returns the value of every string literal in the rule, in no particular order.
+func (r *Rule) Strings() []string {
+	strs := []string{}
+	build.Walk(r.rule.Call, func(x build.Expr, stk []build.Expr) {
+		if str, ok := x.(*build.StringExpr); ok {
+			strs = append(strs, str.Value)
+		}
+	})
+	return strs
+}
+
+// ParseFile reads and parses the BUILD file at path.
+func ParseFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build file: %w", err)
+	}
+	return Parse(path, data)
+}
+
+// Parse parses the contents of a BUILD file.
+func Parse(path string, data []byte) (*File, error) {
+	parsed, err := build.ParseBuild(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	f := &File{Path: path}
+	last := 0
+	for _, expr := range parsed.Stmt {
+		call, ok := expr.(*build.CallExpr)
+		if !ok {
+			continue
+		}
+		kind, ok := call.X.(*build.Ident)
+		if !ok {
+			continue
+		}
+		start, end := call.Span()
+		// Anything after the closing paren on the same line, like a comment, goes with the rule.
+		stop := endOfLine(data, end.Byte)
+		if start.Byte > last {
+			f.Stmts = append(f.Stmts, &Stmt{Raw: string(data[last:start.Byte])})
+		}
+		rule := &Rule{Kind: kind.Name, rule: build.NewRule(call)}
+		stmt := &Stmt{Raw: string(data[start.Byte:stop]), Rule: rule}
+		rule.stmt = stmt
+		f.Stmts = append(f.Stmts, stmt)
+		last = stop
+	}
+	if last < len(data) {
+		f.Stmts = append(f.Stmts, &Stmt{Raw: string(data[last:])})
+	}
+	return f, nil
+}
+
+// Rules returns all of the rules in the file, optionally filtered by kind.
+func (f *File) Rules(kinds ...string) []*Rule {
+	rules := []*Rule{}
+	for _, stmt := range f.Stmts {
+		if stmt.Rule == nil {
+			continue
+		}
+		if len(kinds) == 0 || contains(kinds, stmt.Rule.Kind) {
+			rules = append(rules, stmt.Rule)
+		}
+	}
+	return rules
+}
+
+// Rule returns the rule with the given name, or nil if it does not exist.
+func (f *File) Rule(name string) *Rule {
+	for _, rule := range f.Rules() {
+		if rule.Name() == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Replace replaces the rule with the given text. The text should be one or more
+// complete statements.
+func (f *File) Replace(r *Rule, text string) {
+	for i, stmt := range f.Stmts {
+		if stmt == r.stmt {
+			f.Stmts[i] = &Stmt{Raw: ensureNewline(text)}
+			return
+		}
+	}
+}
+
+// Remove removes the rule from the file, along with the blank line following it.
+func (f *File) Remove(r *Rule) {
+	for i, stmt := range f.Stmts {
+		if stmt != r.stmt {
+			continue
+		}
+		f.Stmts = append(f.Stmts[:i], f.Stmts[i+1:]...)
+		if i < len(f.Stmts) && f.Stmts[i].Rule == nil && strings.HasPrefix(f.Stmts[i].Raw, "\n") {
+			f.Stmts[i] = &Stmt{Raw: strings.TrimPrefix(f.Stmts[i].Raw, "\n")}
+		}
+		return
+	}
+}
+
+// Append adds the text to the end of the file, separated from the existing content
+// by a blank line.
+func (f *File) Append(text string) {
+	content := f.String()
+	switch {
+	case content == "":
+	case strings.HasSuffix(content, "\n\n"):
+	case strings.HasSuffix(content, "\n"):
+		f.Stmts = append(f.Stmts, &Stmt{Raw: "\n"})
+	default:
+		f.Stmts = append(f.Stmts, &Stmt{Raw: "\n\n"})
+	}
+	f.Stmts = append(f.Stmts, &Stmt{Raw: ensureNewline(text)})
+}
+
+// ReplaceStrings calls replace with the value of every string literal in the file, swapping in
+// whatever it returns if it returns true, and returns whether anything changed. Nothing but the
+// strings is touched, so it's safe for things like updating labels. The file is parsed again
+// afterwards, so any rules returned before then are out of date.
+func (f *File) ReplaceStrings(replace func(value string) (string, bool)) (bool, error) {
+	data := f.Bytes()
+	parsed, err := build.ParseBuild(f.Path, data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", f.Path, err)
+	}
+
+	strs := []*build.StringExpr{}
+	build.Walk(parsed, func(x build.Expr, stk []build.Expr) {
+		if str, ok := x.(*build.StringExpr); ok {
+			strs = append(strs, str)
+		}
+	})
+	sort.Slice(strs, func(i, j int) bool {
+		return strs[i].Start.Byte < strs[j].Start.Byte
+	})
+
+	var sb strings.Builder
+	last := 0
+	for _, str := range strs {
+		value, ok := replace(str.Value)
+		if !ok || value == str.Value {
+			continue
+		}
+		sb.Write(data[last:str.Start.Byte])
+		sb.WriteString(strconv.Quote(value))
+		last = str.End.Byte
+	}
+	if last == 0 {
+		return false, nil
+	}
+	sb.Write(data[last:])
+
+	reparsed, err := Parse(f.Path, []byte(sb.String()))
+	if err != nil {
+		return false, err
+	}
+	f.Stmts = reparsed.Stmts
+	return true, nil
+}
+
+// String returns the contents of the file.
+func (f *File) String() string {
+	var sb strings.Builder
+	for _, stmt := range f.Stmts {
+		sb.WriteString(stmt.Raw)
+	}
+	return sb.String()
+}
+
+// Bytes returns the contents of the file.
+func (f *File) Bytes() []byte {
+	return []byte(f.String())
+}
+
+func endOfLine(data []byte, pos int) int {
+	for i := pos; i < len(data); i++ {
+		if data[i] == '\n' {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+func ensureNewline(text string) string {
+	if strings.HasSuffix(text, "\n") {
+		return text
+	}
+	return text + "\n"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,8 +3,9 @@ module github.com/jamesjarvis/go-deps
 go 1.16
 
 require (
+	github.com/bazelbuild/buildtools v0.0.0-20211007154642-8dd79e56e98e
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
 	github.com/urfave/cli/v2 v2.3.0
 	golang.org/x/mod v0.4.2
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
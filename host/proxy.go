@@ -0,0 +1,622 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+const defaultGoProxy = "https://proxy.golang.org,direct"
+
+var (
+	// ErrNotFound is returned when a proxy doesn't have the module or version asked for.
+	ErrNotFound = errors.New("not found")
+	// ErrProxyOff is returned when module lookups have been disabled with GOPROXY=off.
+	ErrProxyOff = errors.New("module lookup disabled by GOPROXY=off")
+)
+
+// Info is the version metadata returned by the .info and @latest endpoints.
+type Info struct {
+	Version string
+	Time    string
+}
+
+// Proxy is a client for the module proxy protocol, see `go help goproxy`.
+// Everything it downloads is stored in cacheDir, using the same layout as the go
+// module cache, so repeated lookups of the same module version are free.
+type Proxy struct {
+	sources  []proxySource
+	noProxy  string
+	cacheDir string
+	client   *http.Client
+	// goTool is the go tool used to fetch modules directly from version control.
+	goTool string
+	// sumdb is the checksum database downloads are verified against, if any.
+	sumdb *SumDB
+	// locks holds a mutex per module version, so concurrent downloads of the same module
+	// version only fetch it once.
+	locks sync.Map
+}
+
+// proxySource is a single entry from the GOPROXY list.
+type proxySource struct {
+	// url is the base URL of the proxy, or "direct" / "off".
+	url string
+	// fallThrough is true if the entry was followed by a pipe rather than a comma,
+	// meaning any error falls back to the next entry, not just a missing module.
+	fallThrough bool
+}
+
+// NewProxy parses a GOPROXY style list of proxies. Entries are separated by commas, in
+// which case we only move on to the next one if the module can't be found, or pipes, in
+// which case we move on after any error. The special entries "direct" and "off" fetch
+// straight from version control (using the go tool) or disable fetching respectively.
+func NewProxy(goproxy, cacheDir string) (*Proxy, error) {
+	if goproxy == "" {
+		goproxy = defaultGoProxy
+	}
+	p := &Proxy{
+		cacheDir: cacheDir,
+		client:   http.DefaultClient,
+		goTool:   FindGoTool(),
+	}
+	for goproxy != "" {
+		var entry proxySource
+		i := strings.IndexAny(goproxy, ",|")
+		if i >= 0 {
+			entry.url, entry.fallThrough, goproxy = goproxy[:i], goproxy[i] == '|', goproxy[i+1:]
+		} else {
+			entry.url, goproxy = goproxy, ""
+		}
+		entry.url = strings.TrimSpace(entry.url)
+		if entry.url == "" {
+			continue
+		}
+		if entry.url != "direct" && entry.url != "off" {
+			u, err := url.Parse(entry.url)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+				return nil, fmt.Errorf("invalid GOPROXY entry %q", entry.url)
+			}
+			entry.url = strings.TrimSuffix(entry.url, "/")
+		}
+		p.sources = append(p.sources, entry)
+	}
+	if len(p.sources) == 0 {
+		return nil, fmt.Errorf("GOPROXY list is empty")
+	}
+	return p, nil
+}
+
+// WithNoProxy sets the GONOPROXY style glob patterns of modules that are always fetched
+// directly, rather than through the proxy list.
+func (p *Proxy) WithNoProxy(patterns string) *Proxy {
+	p.noProxy = patterns
+	return p
+}
+
+// WithGoTool sets the go tool used to fetch modules directly, instead of the one from
+// GOROOT or the PATH.
+func (p *Proxy) WithGoTool(goTool string) *Proxy {
+	p.goTool = goTool
+	return p
+}
+
+// WithSumDB sets the checksum database that newly downloaded modules are verified against.
+// Modules already in the cache were verified when they were downloaded.
+func (p *Proxy) WithSumDB(sumdb *SumDB) *Proxy {
+	p.sumdb = sumdb
+	return p
+}
+
+// WithHTTPClient sets the client used to talk to the proxies.
+func (p *Proxy) WithHTTPClient(client *http.Client) *Proxy {
+	p.client = client
+	return p
+}
+
+var (
+	defaultProxy     *Proxy
+	defaultProxyErr  error
+	defaultProxyOnce sync.Once
+)
+
+// DefaultProxy returns the proxy configured by the environment, through GOPROXY,
+// GONOPROXY and GOPRIVATE, which verifies downloads against DefaultSumDB.
+func DefaultProxy() (*Proxy, error) {
+	defaultProxyOnce.Do(func() {
+		cacheDir, err := GetCacheDir()
+		if err != nil {
+			defaultProxyErr = err
+			return
+		}
+		defaultProxy, defaultProxyErr = NewProxy(os.Getenv("GOPROXY"), filepath.Join(cacheDir, "pkg", "mod"))
+		if defaultProxyErr != nil {
+			return
+		}
+		noProxy := os.Getenv("GONOPROXY")
+		if noProxy == "" {
+			noProxy = os.Getenv("GOPRIVATE")
+		}
+		defaultProxy.WithNoProxy(noProxy)
+
+		sumdb, err := DefaultSumDB()
+		if err != nil {
+			defaultProxyErr = err
+			return
+		}
+		if sumdb != nil {
+			defaultProxy.WithSumDB(sumdb)
+		}
+	})
+	return defaultProxy, defaultProxyErr
+}
+
+// List returns the known versions of the module, in semver order.
+func (p *Proxy) List(ctx context.Context, path string) ([]string, error) {
+	var versions []string
+	err := p.try(path, func(src proxySource) error {
+		if src.url == "direct" {
+			var err error
+			versions, err = p.directList(ctx, path)
+			return err
+		}
+		body, err := p.get(ctx, src, path, "@v/list")
+		if err != nil {
+			return err
+		}
+		versions = strings.Fields(string(body))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of %s: %w", path, err)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// Latest returns the latest version of the module.
+func (p *Proxy) Latest(ctx context.Context, path string) (*Info, error) {
+	return p.Info(ctx, path, "latest")
+}
+
+// Info resolves a version query (a version, commit hash, branch or "latest") to the
+// canonical version of the module.
+func (p *Proxy) Info(ctx context.Context, path, query string) (*Info, error) {
+	if semver.IsValid(query) && semver.Canonical(query) == strings.TrimSuffix(query, "+incompatible") {
+		if data, err := ioutil.ReadFile(p.cachePath(path, query, ".info")); err == nil {
+			return parseInfo(data)
+		}
+	}
+
+	var info *Info
+	err := p.try(path, func(src proxySource) error {
+		if src.url == "direct" {
+			resp, err := p.directDownload(ctx, path, query)
+			if err != nil {
+				return err
+			}
+			info = &Info{Version: resp.Version}
+			return nil
+		}
+		var (
+			data []byte
+			err  error
+		)
+		if query == "latest" {
+			data, err = p.latest(ctx, src, path)
+		} else {
+			data, err = p.get(ctx, src, path, "@v/"+escapeVersion(query)+".info")
+		}
+		if err != nil {
+			return err
+		}
+		info, err = parseInfo(data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s@%s: %w", path, query, err)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(p.cachePath(path, info.Version, ".info"), data)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// latest asks the proxy for the latest version of a module, falling back to the highest
+// version in the version list if the proxy doesn't support the @latest endpoint.
+func (p *Proxy) latest(ctx context.Context, src proxySource, path string) ([]byte, error) {
+	data, err := p.get(ctx, src, path, "@latest")
+	if err == nil || !errors.Is(err, ErrNotFound) {
+		return data, err
+	}
+	body, err := p.get(ctx, src, path, "@v/list")
+	if err != nil {
+		return nil, err
+	}
+	// Prefer releases over pre-releases, the same way the go tool does.
+	versions := strings.Fields(string(body))
+	latest := ""
+	for _, version := range versions {
+		if semver.Prerelease(version) == "" && semver.Compare(version, latest) > 0 {
+			latest = version
+		}
+	}
+	if latest == "" {
+		for _, version := range versions {
+			if semver.Compare(version, latest) > 0 {
+				latest = version
+			}
+		}
+	}
+	if latest == "" {
+		return nil, ErrNotFound
+	}
+	return p.get(ctx, src, path, "@v/"+escapeVersion(latest)+".info")
+}
+
+// DownloadGoMod downloads just the go.mod file of the module at the version matching the
+// query, which is all we need to work out the module's requirements.
+func (p *Proxy) DownloadGoMod(ctx context.Context, path, query string) (*GoModDownloadResponse, error) {
+	info, err := p.Info(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	version := info.Version
+	defer p.lock(path, version)()
+
+	modPath := p.cachePath(path, version, ".mod")
+	fetched := false
+	if _, err := os.Stat(modPath); os.IsNotExist(err) {
+		var data []byte
+		err := p.try(path, func(src proxySource) error {
+			if src.url == "direct" {
+				resp, err := p.directDownload(ctx, path, version)
+				if err != nil {
+					return err
+				}
+				data, err = ioutil.ReadFile(resp.GoMod)
+				return err
+			}
+			data, err = p.get(ctx, src, path, "@v/"+escapeVersion(version)+".mod")
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to download go.mod of %s@%s: %w", path, version, err)
+		}
+		err = writeFileAtomic(modPath, data)
+		if err != nil {
+			return nil, err
+		}
+		fetched = true
+	}
+
+	goModSum, err := hashGoMod(modPath)
+	if err != nil {
+		return nil, err
+	}
+	// Anything already in the cache was checked when it was downloaded.
+	if fetched && p.sumdb != nil {
+		if err := p.sumdb.VerifyGoMod(path, version, goModSum); err != nil {
+			os.Remove(modPath)
+			return nil, err
+		}
+	}
+	return &GoModDownloadResponse{
+		Path:     path,
+		Version:  version,
+		Info:     p.cachePath(path, version, ".info"),
+		GoMod:    modPath,
+		GoModSum: goModSum,
+	}, nil
+}
+
+// Download downloads the module at the version matching the query, and extracts it into
+// the cache directory.
+func (p *Proxy) Download(ctx context.Context, path, query string) (*GoModDownloadResponse, error) {
+	resp, err := p.DownloadGoMod(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	version := resp.Version
+	defer p.lock(path, version)()
+
+	zipPath := p.cachePath(path, version, ".zip")
+	fetched := false
+	if _, err := os.Stat(zipPath); os.IsNotExist(err) {
+		var data []byte
+		err := p.try(path, func(src proxySource) error {
+			if src.url == "direct" {
+				resp, err := p.directDownload(ctx, path, version)
+				if err != nil {
+					return err
+				}
+				data, err = ioutil.ReadFile(resp.Zip)
+				return err
+			}
+			data, err = p.get(ctx, src, path, "@v/"+escapeVersion(version)+".zip")
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to download zip of %s@%s: %w", path, version, err)
+		}
+		err = writeFileAtomic(zipPath, data)
+		if err != nil {
+			return nil, err
+		}
+		fetched = true
+	}
+
+	sum, err := dirhash.HashZip(zipPath, dirhash.Hash1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash zip of %s@%s: %w", path, version, err)
+	}
+	if fetched && p.sumdb != nil {
+		if err := p.sumdb.VerifyZip(path, version, sum); err != nil {
+			os.Remove(zipPath)
+			return nil, err
+		}
+	}
+
+	dir, err := p.extract(path, version, zipPath)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Zip = zipPath
+	resp.Dir = dir
+	resp.Sum = sum
+	return resp, nil
+}
+
+// lock locks the module version, returning the function to unlock it again.
+func (p *Proxy) lock(path, version string) func() {
+	mu, _ := p.locks.LoadOrStore(path+"@"+version, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// extract unzips the module into the cache directory, if it hasn't been already.
+func (p *Proxy) extract(path, version, zipPath string) (string, error) {
+	escPath, err := module.EscapePath(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(p.cacheDir, escPath+"@"+escapeVersion(version))
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	// Extract into a temporary directory first so that we never leave a half
+	// extracted module lying around.
+	err = os.MkdirAll(filepath.Dir(dir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	err = modzip.Unzip(tmpDir, module.Version{Path: path, Version: version}, zipPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract %s@%s: %w", path, version, err)
+	}
+	err = os.Rename(tmpDir, dir)
+	if err != nil && !os.IsExist(err) {
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return "", fmt.Errorf("failed to extract %s@%s: %w", path, version, err)
+		}
+	}
+	return dir, nil
+}
+
+// try runs fn against each of the proxies in turn, until one of them succeeds.
+func (p *Proxy) try(path string, fn func(src proxySource) error) error {
+	sources := p.sources
+	if p.noProxy != "" && module.MatchPrefixPatterns(p.noProxy, path) {
+		sources = []proxySource{{url: "direct"}}
+	}
+
+	var firstErr error
+	for _, src := range sources {
+		if src.url == "off" {
+			if firstErr == nil {
+				firstErr = ErrProxyOff
+			}
+			break
+		}
+		err := fn(src)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !src.fallThrough && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return firstErr
+}
+
+// get fetches the file at <proxy>/<escaped module path>/<file>.
+func (p *Proxy) get(ctx context.Context, src proxySource, path, file string) ([]byte, error) {
+	escPath, err := module.EscapePath(path)
+	if err != nil {
+		return nil, err
+	}
+	target := src.url + "/" + escPath + "/" + file
+
+	if strings.HasPrefix(target, "file://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(filepath.FromSlash(u.Path))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", target, ErrNotFound)
+		}
+		return data, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", target, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("%s: %s: %w", target, strings.TrimSpace(string(body)), ErrNotFound)
+	default:
+		return nil, fmt.Errorf("failed to fetch %s: %s: %s", target, resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// directDownload fetches the module straight from version control, using the go tool.
+func (p *Proxy) directDownload(ctx context.Context, path, query string) (*GoModDownloadResponse, error) {
+	out, err := p.runGo(ctx, "mod", "download", "-json", path+"@"+query)
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	resp := new(struct {
+		GoModDownloadResponse
+		Error string
+	})
+	err = json.Unmarshal(out, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal output: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("failed to download module: %s", resp.Error)
+	}
+	return &resp.GoModDownloadResponse, nil
+}
+
+// directList lists the versions of the module straight from version control, using the go tool.
+func (p *Proxy) directList(ctx context.Context, path string) ([]string, error) {
+	out, err := p.runGo(ctx, "list", "-m", "-json", "-versions", path+"@latest")
+	if err != nil {
+		return nil, err
+	}
+	resp := new(struct {
+		Versions []string
+	})
+	err = json.Unmarshal(out, resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal output: %w", err)
+	}
+	return resp.Versions, nil
+}
+
+func (p *Proxy) runGo(ctx context.Context, args ...string) ([]byte, error) {
+	err := os.MkdirAll(p.cacheDir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, p.goTool, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), "GOPROXY=direct", "GO111MODULE=on", "GOFLAGS=-mod=mod", fmt.Sprintf("GOMODCACHE=%s", p.cacheDir))
+	cmd.Dir = p.cacheDir
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("go %s failed: %s: %w", strings.Join(args, " "), stderr.String(), err)
+	}
+	return out, nil
+}
+
+// cachePath returns the path to a file in the download cache, such as the .mod or .zip.
+func (p *Proxy) cachePath(path, version, ext string) string {
+	escPath, err := module.EscapePath(path)
+	if err != nil {
+		escPath = path
+	}
+	return filepath.Join(p.cacheDir, "cache", "download", escPath, "@v", escapeVersion(version)+ext)
+}
+
+// writeFileAtomic writes a file, such that nothing ever sees it half written.
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func parseInfo(data []byte) (*Info, error) {
+	info := new(Info)
+	err := json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal version info: %w", err)
+	}
+	if info.Version == "" {
+		return nil, fmt.Errorf("version info is missing a version")
+	}
+	return info, nil
+}
+
+// hashGoMod returns the go.sum style hash of a go.mod file.
+func hashGoMod(path string) (string, error) {
+	sum, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return sum, nil
+}
+
+func escapeVersion(version string) string {
+	escaped, err := module.EscapeVersion(version)
+	if err != nil {
+		return version
+	}
+	return escaped
+}
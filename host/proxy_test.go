@@ -0,0 +1,328 @@
+package host
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeProxy serves module proxy files from memory, and records what was asked for.
+type fakeProxy struct {
+	files map[string][]byte
+	// status is returned for every request instead of the files, if set.
+	status int
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeProxy() *fakeProxy {
+	return &fakeProxy{files: map[string][]byte{}}
+}
+
+func (f *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	f.mu.Lock()
+	f.requests = append(f.requests, path)
+	f.mu.Unlock()
+
+	if f.status != 0 {
+		http.Error(w, "broken", f.status)
+		return
+	}
+	data, ok := f.files[path]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
+
+func (f *fakeProxy) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// addModule adds the .info, .mod and .zip of a module with a single package to the proxy.
+func (f *fakeProxy) addModule(t *testing.T, path, version string) {
+	t.Helper()
+	goMod := fmt.Sprintf("module %s\n", path)
+	f.files[path+"/@v/"+version+".info"] = []byte(fmt.Sprintf(`{"Version":%q,"Time":"2020-01-01T00:00:00Z"}`, version))
+	f.files[path+"/@v/"+version+".mod"] = []byte(goMod)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"go.mod": goMod, "lib.go": "package lib\n"} {
+		fw, err := w.Create(path + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.files[path+"/@v/"+version+".zip"] = buf.Bytes()
+}
+
+// serve starts a server for the proxy, returning its URL.
+func (f *fakeProxy) serve(t *testing.T) string {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// newTestProxy returns a proxy for the GOPROXY list, caching into a temporary directory.
+func newTestProxy(t *testing.T, goproxy string) *Proxy {
+	t.Helper()
+	p, err := NewProxy(goproxy, t.TempDir())
+	if err != nil {
+		t.Fatalf("NewProxy(%q) failed: %v", goproxy, err)
+	}
+	return p
+}
+
+func TestList(t *testing.T) {
+	fake := newFakeProxy()
+	fake.files["example.com/!foo/@v/list"] = []byte("v1.1.0\nv1.0.0\nv1.2.0-pre\n")
+	p := newTestProxy(t, fake.serve(t))
+
+	versions, err := p.List(context.Background(), "example.com/Foo")
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	want := []string{"v1.0.0", "v1.1.0", "v1.2.0-pre"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("List() = %v, want %v", versions, want)
+	}
+
+	_, err = p.List(context.Background(), "example.com/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("List() of a missing module error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	fake := newFakeProxy()
+	fake.addModule(t, "example.com/a", "v1.0.0")
+	p := newTestProxy(t, fake.serve(t))
+
+	for i := 0; i < 2; i++ {
+		info, err := p.Info(context.Background(), "example.com/a", "v1.0.0")
+		if err != nil {
+			t.Fatalf("Info() failed: %v", err)
+		}
+		if info.Version != "v1.0.0" {
+			t.Errorf("Info() = %s, want v1.0.0", info.Version)
+		}
+	}
+	// The second lookup should come from the cache.
+	if got := fake.requested(); len(got) != 1 {
+		t.Errorf("requested %v, want just the .info once", got)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "latest endpoint",
+			files: map[string]string{
+				"example.com/a/@latest": `{"Version":"v1.1.0"}`,
+				"example.com/a/@v/list": "v1.0.0\nv1.2.0\n",
+			},
+			want: "v1.1.0",
+		},
+		{
+			name: "falls back to the highest release",
+			files: map[string]string{
+				"example.com/a/@v/list":        "v1.0.0\nv1.2.0\nv1.1.0\nv1.3.0-pre\n",
+				"example.com/a/@v/v1.2.0.info": `{"Version":"v1.2.0"}`,
+			},
+			want: "v1.2.0",
+		},
+		{
+			name: "falls back to the highest pre-release without any releases",
+			files: map[string]string{
+				"example.com/a/@v/list":            "v1.3.0-pre\nv1.3.0-alpha\n",
+				"example.com/a/@v/v1.3.0-pre.info": `{"Version":"v1.3.0-pre"}`,
+			},
+			want: "v1.3.0-pre",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeProxy()
+			for name, content := range test.files {
+				fake.files[name] = []byte(content)
+			}
+			p := newTestProxy(t, fake.serve(t))
+			info, err := p.Latest(context.Background(), "example.com/a")
+			if err != nil {
+				t.Fatalf("Latest() failed: %v", err)
+			}
+			if info.Version != test.want {
+				t.Errorf("Latest() = %s, want %s", info.Version, test.want)
+			}
+		})
+	}
+
+	p := newTestProxy(t, newFakeProxy().serve(t))
+	if _, err := p.Latest(context.Background(), "example.com/a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Latest() of a missing module error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	fake := newFakeProxy()
+	fake.addModule(t, "example.com/a", "v1.0.0")
+	p := newTestProxy(t, fake.serve(t))
+
+	goMod, err := p.DownloadGoMod(context.Background(), "example.com/a", "v1.0.0")
+	if err != nil {
+		t.Fatalf("DownloadGoMod() failed: %v", err)
+	}
+	if data, err := ioutil.ReadFile(goMod.GoMod); err != nil || string(data) != "module example.com/a\n" {
+		t.Errorf("DownloadGoMod() go.mod = %q, %v", data, err)
+	}
+	if !strings.HasPrefix(goMod.GoModSum, "h1:") {
+		t.Errorf("DownloadGoMod() go.mod sum = %q, want an h1: hash", goMod.GoModSum)
+	}
+
+	resp, err := p.Download(context.Background(), "example.com/a", "v1.0.0")
+	if err != nil {
+		t.Fatalf("Download() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(resp.Dir, "lib.go")); err != nil {
+		t.Errorf("Download() didn't extract the module: %v", err)
+	}
+	if !strings.HasPrefix(resp.Sum, "h1:") {
+		t.Errorf("Download() sum = %q, want an h1: hash", resp.Sum)
+	}
+
+	want := []string{"example.com/a/@v/v1.0.0.info", "example.com/a/@v/v1.0.0.mod", "example.com/a/@v/v1.0.0.zip"}
+	if _, err := p.Download(context.Background(), "example.com/a", "v1.0.0"); err != nil {
+		t.Fatalf("Download() from the cache failed: %v", err)
+	}
+	if got := fake.requested(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requested %v, want %v", got, want)
+	}
+}
+
+func TestFallThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		// status is what the first proxy responds with.
+		status    int
+		separator string
+		// fellThrough is whether the second proxy should have been asked.
+		fellThrough bool
+	}{
+		{name: "comma on not found", status: http.StatusNotFound, separator: ",", fellThrough: true},
+		{name: "comma on gone", status: http.StatusGone, separator: ",", fellThrough: true},
+		{name: "comma on other errors", status: http.StatusInternalServerError, separator: ",", fellThrough: false},
+		{name: "pipe on not found", status: http.StatusNotFound, separator: "|", fellThrough: true},
+		{name: "pipe on other errors", status: http.StatusInternalServerError, separator: "|", fellThrough: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := newFakeProxy()
+			first.status = test.status
+			second := newFakeProxy()
+			second.addModule(t, "example.com/a", "v1.0.0")
+			p := newTestProxy(t, first.serve(t)+test.separator+second.serve(t))
+
+			info, err := p.Info(context.Background(), "example.com/a", "v1.0.0")
+			if test.fellThrough {
+				if err != nil {
+					t.Fatalf("Info() failed: %v", err)
+				}
+				if info.Version != "v1.0.0" {
+					t.Errorf("Info() = %s, want v1.0.0", info.Version)
+				}
+			} else if err == nil {
+				t.Errorf("Info() succeeded, want the error from the first proxy")
+			}
+			if asked := len(second.requested()) > 0; asked != test.fellThrough {
+				t.Errorf("second proxy asked = %v, want %v", asked, test.fellThrough)
+			}
+		})
+	}
+}
+
+func TestOff(t *testing.T) {
+	p := newTestProxy(t, "off")
+	if _, err := p.Info(context.Background(), "example.com/a", "v1.0.0"); !errors.Is(err, ErrProxyOff) {
+		t.Errorf("Info() error = %v, want %v", err, ErrProxyOff)
+	}
+
+	// Lookups stop at off, so the error from the proxy before it is the one returned.
+	fake := newFakeProxy()
+	after := newFakeProxy()
+	after.addModule(t, "example.com/a", "v1.0.0")
+	p = newTestProxy(t, fake.serve(t)+",off,"+after.serve(t))
+	if _, err := p.Info(context.Background(), "example.com/a", "v1.0.0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Info() error = %v, want %v", err, ErrNotFound)
+	}
+	if got := after.requested(); len(got) != 0 {
+		t.Errorf("proxy after off was asked for %v", got)
+	}
+}
+
+func TestFileProxy(t *testing.T) {
+	fake := newFakeProxy()
+	fake.addModule(t, "example.com/a", "v1.0.0")
+	fake.files["example.com/a/@v/list"] = []byte("v1.0.0\n")
+	dir := t.TempDir()
+	for name, data := range fake.files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newTestProxy(t, "file://"+filepath.ToSlash(dir))
+
+	info, err := p.Latest(context.Background(), "example.com/a")
+	if err != nil {
+		t.Fatalf("Latest() failed: %v", err)
+	}
+	if info.Version != "v1.0.0" {
+		t.Errorf("Latest() = %s, want v1.0.0", info.Version)
+	}
+	resp, err := p.Download(context.Background(), "example.com/a", "v1.0.0")
+	if err != nil {
+		t.Fatalf("Download() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(resp.Dir, "lib.go")); err != nil {
+		t.Errorf("Download() didn't extract the module: %v", err)
+	}
+	if _, err := p.Info(context.Background(), "example.com/missing", "v1.0.0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Info() of a missing module error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestNewProxy(t *testing.T) {
+	for _, goproxy := range []string{"ftp://example.com", ",", "not a url"} {
+		if _, err := NewProxy(goproxy, t.TempDir()); err == nil {
+			t.Errorf("NewProxy(%q) succeeded, want an error", goproxy)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package host
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+)
+
+const (
+	defaultSumDB = "sum.golang.org"
+	// defaultSumDBKey is the public key of sum.golang.org, the same one built into the go tool.
+	defaultSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+)
+
+// SumDB verifies module hashes against a checksum database, see `go help module-auth`.
+// The signed tree heads it has seen are kept in configDir, and the tiles it has downloaded
+// are cached in cacheDir, so the database only has to prove that it hasn't changed its
+// mind on later runs.
+type SumDB struct {
+	client  *sumdb.Client
+	noSumDB string
+	name    string
+}
+
+// NewSumDB parses a GOSUMDB style description of the checksum database to use, which is
+// its name, optionally followed by its public key and URL, separated by spaces. Only
+// sum.golang.org can be given without a key.
+func NewSumDB(gosumdb, configDir, cacheDir string) (*SumDB, error) {
+	if gosumdb == "" {
+		gosumdb = defaultSumDB
+	}
+	fields := strings.Fields(gosumdb)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("GOSUMDB %q doesn't name a checksum database", gosumdb)
+	}
+	key := fields[0]
+	if key == defaultSumDB {
+		key = defaultSumDBKey
+	}
+	i := strings.Index(key, "+")
+	if i < 0 {
+		return nil, fmt.Errorf("GOSUMDB %q needs a public key", gosumdb)
+	}
+	name := key[:i]
+	url := "https://" + name
+	if len(fields) > 1 {
+		url = strings.TrimSuffix(fields[1], "/")
+	}
+
+	ops := &sumdbOps{
+		key:       key,
+		url:       url,
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		client:    http.DefaultClient,
+	}
+	return &SumDB{
+		client: sumdb.NewClient(ops),
+		name:   name,
+	}, nil
+}
+
+// WithNoSumDB sets the GONOSUMDB style glob patterns of modules that aren't checked
+// against the checksum database.
+func (s *SumDB) WithNoSumDB(patterns string) *SumDB {
+	s.noSumDB = patterns
+	return s
+}
+
+var (
+	defaultSumDBOnce sync.Once
+	defaultSumDBVal  *SumDB
+	defaultSumDBErr  error
+)
+
+// DefaultSumDB returns the checksum database configured by the environment, through
+// GOSUMDB, GONOSUMDB (or GONOSUMCHECK) and GOPRIVATE. It returns nil if checking has
+// been turned off with GOSUMDB=off.
+func DefaultSumDB() (*SumDB, error) {
+	defaultSumDBOnce.Do(func() {
+		cacheDir, err := GetCacheDir()
+		if err != nil {
+			defaultSumDBErr = err
+			return
+		}
+		defaultSumDBVal, defaultSumDBErr = sumDBFromEnv(cacheDir)
+	})
+	return defaultSumDBVal, defaultSumDBErr
+}
+
+// sumDBFromEnv returns the checksum database configured by the environment, keeping its
+// state under cacheDir like the go tool does under GOPATH.
+func sumDBFromEnv(cacheDir string) (*SumDB, error) {
+	gosumdb := os.Getenv("GOSUMDB")
+	if gosumdb == "off" {
+		return nil, nil
+	}
+	s, err := NewSumDB(
+		gosumdb,
+		filepath.Join(cacheDir, "pkg", "sumdb"),
+		filepath.Join(cacheDir, "pkg", "mod", "cache", "download", "sumdb"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.WithNoSumDB(noSumDBPatterns()), nil
+}
+
+// noSumDBPatterns returns the patterns of modules that aren't checked from the environment,
+// which are GONOSUMDB and GONOSUMCHECK, or GOPRIVATE if neither is set.
+func noSumDBPatterns() string {
+	noSumDB := strings.Trim(os.Getenv("GONOSUMDB")+","+os.Getenv("GONOSUMCHECK"), ",")
+	if noSumDB == "" {
+		noSumDB = os.Getenv("GOPRIVATE")
+	}
+	return noSumDB
+}
+
+// VerifyZip checks the hash of the module's zip against the checksum database.
+func (s *SumDB) VerifyZip(path, version, sum string) error {
+	return s.verify(path, version, sum)
+}
+
+// VerifyGoMod checks the hash of the module's go.mod file against the checksum database.
+func (s *SumDB) VerifyGoMod(path, version, goModSum string) error {
+	return s.verify(path, version+"/go.mod", goModSum)
+}
+
+// verify checks the hash against the one the database has for the module version, which
+// has /go.mod on the end for the hash of the go.mod file, as in go.sum.
+func (s *SumDB) verify(path, version, sum string) error {
+	if module.MatchPrefixPatterns(s.noSumDB, path) {
+		return nil
+	}
+	lines, err := s.client.Lookup(path, version)
+	if err != nil {
+		return fmt.Errorf("failed to look up %s@%s in the checksum database %s: %w", path, version, s.name, err)
+	}
+	prefix := path + " " + version + " "
+	for _, line := range lines {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		if want := strings.TrimPrefix(line, prefix); want != sum {
+			return fmt.Errorf("checksum mismatch for %s %s:\n\tdownloaded: %s\n\t%s: %s\nthe module may have been tampered with", path, version, sum, s.name, want)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s %s is missing from the checksum database %s", path, version, s.name)
+}
+
+// sumdbOps provides the sumdb client with access to the database and somewhere to keep
+// its state.
+type sumdbOps struct {
+	key, url  string
+	configDir string
+	cacheDir  string
+	client    *http.Client
+	// mutex guards the config files, which have to be updated atomically.
+	mutex sync.Mutex
+}
+
+// ReadRemote fetches a file from the checksum database.
+func (ops *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := ops.client.Get(ops.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s%s: %s", ops.url, path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ReadConfig returns the database key, or the latest signed tree head we have seen.
+func (ops *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(ops.key), nil
+	}
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(ops.configDir, filepath.FromSlash(file)))
+	if os.IsNotExist(err) {
+		// We haven't seen this database before, so we start with an empty tree.
+		return nil, nil
+	}
+	return data, err
+}
+
+// WriteConfig updates a config file, as long as it hasn't changed since it was last read.
+func (ops *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	ops.mutex.Lock()
+	defer ops.mutex.Unlock()
+	path := filepath.Join(ops.configDir, filepath.FromSlash(file))
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if string(current) != string(old) {
+		return sumdb.ErrWriteConflict
+	}
+	return writeFileAtomic(path, new)
+}
+
+// ReadCache returns a cached tile.
+func (ops *sumdbOps) ReadCache(file string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(ops.cacheDir, filepath.FromSlash(file)))
+}
+
+// WriteCache caches a tile. Failing to do so isn't fatal, we'll just fetch it again.
+func (ops *sumdbOps) WriteCache(file string, data []byte) {
+	_ = writeFileAtomic(filepath.Join(ops.cacheDir, filepath.FromSlash(file)), data)
+}
+
+func (ops *sumdbOps) Log(msg string) {}
+
+func (ops *sumdbOps) SecurityError(msg string) {
+	log.Print(msg)
+}
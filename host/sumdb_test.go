@@ -0,0 +1,269 @@
+package host
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// fakeSumDB is an in-process checksum database, which records what was asked of it.
+type fakeSumDB struct {
+	url, vkey string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// newFakeSumDB starts a checksum database serving the go.sum lines from gosum, which maps
+// path@version to the lines for it.
+func newFakeSumDB(t *testing.T, gosum map[string]string) *fakeSumDB {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := sumdb.NewServer(sumdb.NewTestServer(skey, func(path, version string) ([]byte, error) {
+		lines, ok := gosum[path+"@"+version]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(lines), nil
+	}))
+	fake := &fakeSumDB{vkey: vkey}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		fake.requests = append(fake.requests, r.URL.Path)
+		fake.mu.Unlock()
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(httpServer.Close)
+	fake.url = httpServer.URL
+	return fake
+}
+
+// requested returns the requests made since the last call, with the given prefix.
+func (f *fakeSumDB) requested(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matching []string
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, prefix) {
+			matching = append(matching, req)
+		}
+	}
+	f.requests = nil
+	return matching
+}
+
+// client returns a client for the database, keeping its state in the directories.
+func (f *fakeSumDB) client(t *testing.T, configDir, cacheDir string) *SumDB {
+	t.Helper()
+	s, err := NewSumDB(f.vkey+" "+f.url, configDir, cacheDir)
+	if err != nil {
+		t.Fatalf("NewSumDB() failed: %v", err)
+	}
+	return s
+}
+
+var testGoSum = map[string]string{
+	"example.com/a@v1.0.0":       "example.com/a v1.0.0 h1:zip=\nexample.com/a v1.0.0/go.mod h1:mod=\n",
+	"example.com/b@v1.0.0":       "example.com/b v1.0.0/go.mod h1:mod=\n",
+	"example.com/private@v1.0.0": "example.com/private v1.0.0 h1:zip=\n",
+}
+
+func TestVerify(t *testing.T) {
+	fake := newFakeSumDB(t, testGoSum)
+	s := fake.client(t, t.TempDir(), t.TempDir())
+
+	if err := s.VerifyZip("example.com/a", "v1.0.0", "h1:zip="); err != nil {
+		t.Errorf("VerifyZip() failed: %v", err)
+	}
+	if err := s.VerifyGoMod("example.com/a", "v1.0.0", "h1:mod="); err != nil {
+		t.Errorf("VerifyGoMod() failed: %v", err)
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	fake := newFakeSumDB(t, testGoSum)
+	s := fake.client(t, t.TempDir(), t.TempDir())
+
+	err := s.VerifyZip("example.com/a", "v1.0.0", "h1:tampered=")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("VerifyZip() error = %v, want a checksum mismatch", err)
+	}
+	err = s.VerifyGoMod("example.com/a", "v1.0.0", "h1:zip=")
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("VerifyGoMod() error = %v, want a checksum mismatch", err)
+	}
+}
+
+func TestVerifyMissing(t *testing.T) {
+	fake := newFakeSumDB(t, testGoSum)
+	s := fake.client(t, t.TempDir(), t.TempDir())
+
+	// The database doesn't know about the module at all.
+	err := s.VerifyZip("example.com/missing", "v1.0.0", "h1:zip=")
+	if err == nil || !strings.Contains(err.Error(), "failed to look up") {
+		t.Errorf("VerifyZip() of an unknown module error = %v, want a failed lookup", err)
+	}
+	// The database knows about the module, but only has the hash of its go.mod.
+	err = s.VerifyZip("example.com/b", "v1.0.0", "h1:zip=")
+	if err == nil || !strings.Contains(err.Error(), "missing from the checksum database") {
+		t.Errorf("VerifyZip() error = %v, want the hash to be missing", err)
+	}
+}
+
+func TestVerifySkipsNoSumDB(t *testing.T) {
+	fake := newFakeSumDB(t, testGoSum)
+	s := fake.client(t, t.TempDir(), t.TempDir()).WithNoSumDB("example.com/private,*.corp.com")
+
+	// These would fail if they were checked.
+	for _, path := range []string{"example.com/private", "example.com/private/sub", "git.corp.com/x"} {
+		if err := s.VerifyZip(path, "v1.0.0", "h1:tampered="); err != nil {
+			t.Errorf("VerifyZip(%s) failed: %v", path, err)
+		}
+	}
+	if got := fake.requested(""); len(got) != 0 {
+		t.Errorf("checksum database was asked for %v, want nothing", got)
+	}
+	if err := s.VerifyZip("example.com/a", "v1.0.0", "h1:tampered="); err == nil {
+		t.Errorf("VerifyZip() of a module that isn't skipped succeeded, want a checksum mismatch")
+	}
+}
+
+func TestNoSumDBPatterns(t *testing.T) {
+	tests := []struct {
+		name                               string
+		gonosumdb, gonosumcheck, goprivate string
+		want                               string
+	}{
+		{name: "nothing"},
+		{name: "GONOSUMDB", gonosumdb: "a.com", goprivate: "b.com", want: "a.com"},
+		{name: "GONOSUMCHECK", gonosumcheck: "c.com", goprivate: "b.com", want: "c.com"},
+		{name: "both", gonosumdb: "a.com", gonosumcheck: "c.com", want: "a.com,c.com"},
+		{name: "GOPRIVATE", goprivate: "b.com", want: "b.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "GONOSUMDB", test.gonosumdb)
+			setenv(t, "GONOSUMCHECK", test.gonosumcheck)
+			setenv(t, "GOPRIVATE", test.goprivate)
+			if got := noSumDBPatterns(); got != test.want {
+				t.Errorf("noSumDBPatterns() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// setenv sets the environment variable for the rest of the test.
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestVerifyCachesTiles(t *testing.T) {
+	fake := newFakeSumDB(t, testGoSum)
+	configDir, cacheDir := t.TempDir(), t.TempDir()
+
+	if err := fake.client(t, configDir, cacheDir).VerifyZip("example.com/a", "v1.0.0", "h1:zip="); err != nil {
+		t.Fatalf("VerifyZip() failed: %v", err)
+	}
+	if got := fake.requested("/tile/"); len(got) == 0 {
+		t.Fatalf("didn't fetch any tiles, want them to prove the lookup")
+	}
+
+	// A new client, as on the next run, should get the tiles from the cache.
+	if err := fake.client(t, configDir, cacheDir).VerifyZip("example.com/a", "v1.0.0", "h1:zip="); err != nil {
+		t.Fatalf("VerifyZip() failed: %v", err)
+	}
+	if got := fake.requested("/tile/"); len(got) != 0 {
+		t.Errorf("fetched %v again, want them from the cache", got)
+	}
+}
+
+func TestNewSumDB(t *testing.T) {
+	for _, gosumdb := range []string{" ", "\t", "sum.test", "sum.test https://sum.test"} {
+		if _, err := NewSumDB(gosumdb, t.TempDir(), t.TempDir()); err == nil {
+			t.Errorf("NewSumDB(%q) succeeded, want an error", gosumdb)
+		}
+	}
+}
+
+func TestProxyVerifiesDownloads(t *testing.T) {
+	proxy := newFakeProxy()
+	proxy.addModule(t, "example.com/a", "v1.0.0")
+	goModPath := filepath.Join(t.TempDir(), "go.mod")
+	if err := ioutil.WriteFile(goModPath, proxy.files["example.com/a/@v/v1.0.0.mod"], 0600); err != nil {
+		t.Fatal(err)
+	}
+	goModSum, err := hashGoMod(goModPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database has the real go.mod, but a different zip to the one the proxy serves.
+	fake := newFakeSumDB(t, map[string]string{
+		"example.com/a@v1.0.0": "example.com/a v1.0.0 h1:zip=\nexample.com/a v1.0.0/go.mod " + goModSum + "\n",
+	})
+	proxyURL := proxy.serve(t)
+
+	tests := []struct {
+		name             string
+		gosumdb, nosumdb string
+		wantErr          bool
+	}{
+		{name: "checked", gosumdb: fake.vkey + " " + fake.url, wantErr: true},
+		{name: "GONOSUMDB", gosumdb: fake.vkey + " " + fake.url, nosumdb: "example.com/a"},
+		{name: "GOSUMDB=off", gosumdb: "off"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, "GOSUMDB", test.gosumdb)
+			setenv(t, "GONOSUMDB", test.nosumdb)
+			setenv(t, "GONOSUMCHECK", "")
+			setenv(t, "GOPRIVATE", "")
+			s, err := sumDBFromEnv(t.TempDir())
+			if err != nil {
+				t.Fatalf("sumDBFromEnv() failed: %v", err)
+			}
+			p := newTestProxy(t, proxyURL)
+			if s != nil {
+				p.WithSumDB(s)
+			}
+
+			_, err = p.Download(context.Background(), "example.com/a", "v1.0.0")
+			if !test.wantErr {
+				if err != nil {
+					t.Errorf("Download() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatalf("Download() error = %v, want a checksum mismatch", err)
+			}
+			// The bad zip mustn't be left in the cache, where it would be trusted next time.
+			if _, err := os.Stat(p.cachePath("example.com/a", "v1.0.0", ".zip")); !os.IsNotExist(err) {
+				t.Errorf("tampered zip was left in the cache: %v", err)
+			}
+			if _, err := p.Download(context.Background(), "example.com/a", "v1.0.0"); err == nil {
+				t.Errorf("second Download() succeeded, want the zip to be checked again")
+			}
+		})
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/jamesjarvis/go-deps/host"
 	"github.com/jamesjarvis/go-deps/module"
+	"github.com/jamesjarvis/go-deps/plzconfig"
 	"github.com/urfave/cli/v2"
 )
 
@@ -14,6 +18,28 @@ const (
 	moduleFlag = "module"
 	versionFlag = "version"
 	thirdPartyFlag = "third_party"
+	jobsFlag = "jobs"
+	fromGoModFlag = "from-gomod"
+	dryRunFlag = "dry-run"
+	goSumFlag = "go-sum"
+	allFlag = "all"
+	minorFlag = "minor"
+	patchFlag = "patch"
+	jsonFlag = "json"
+	formatFlag = "format"
+	updateFlag = "update"
+	profileFlag = "profile"
+	nameFlag = "name"
+	layoutFlag = "layout"
+	rulesFlag = "rules"
+	platformFlag = "platform"
+)
+
+var (
+	// config is the Please config of the repo we're running in.
+	config *plzconfig.Config
+	// workDir is the directory we were run from, before moving to the repo root.
+	workDir string
 )
 
 // This binary will accept a module name and optionally a semver or commit hash, and will add this module to a BUILD file.
@@ -22,55 +48,355 @@ func main() {
 		Name:  "please-go-get",
 		Usage: "Add a Go Module to an existing Please Monorepo",
 		Flags: []cli.Flag{
-			&cli.StringFlag{
+			&cli.StringSliceFlag{
 				Name:    moduleFlag,
 				Aliases: []string{"m"},
-				Usage:   "Module to add",
-				Required: true,
+				Usage:   "Module to add, as path or path@version. Can be given more than once",
 			},
 			&cli.StringFlag{
 				Name:    versionFlag,
 				Aliases: []string{"v"},
-				Usage:   "Version of the module to add",
+				Usage:   "Version of the module to add, if only one is given",
+			},
+			&cli.StringSliceFlag{
+				Name:  nameFlag,
+				Usage: "Name to give the rule of a new module instead of the default, as path=name. Can be given more than once",
+			},
+			&cli.StringFlag{
+				Name:  fromGoModFlag,
+				Usage: "Add every module required by this go.mod file, applying its replace and exclude directives",
+			},
+			&cli.StringFlag{
+				Name:  goSumFlag,
+				Usage: "Check downloaded modules against the hashes in this go.sum file",
+			},
+			&cli.BoolFlag{
+				Name:  dryRunFlag,
+				Usage: "Print a diff of the changes to the BUILD files instead of writing them",
+			},
+			&cli.BoolFlag{
+				Name:  updateFlag,
+				Usage: "Ignore the versions in the lock file, and resolve everything from scratch",
 			},
 			&cli.StringFlag{
 				Name:    thirdPartyFlag,
-				DefaultText: "third_party/go",
-				Usage:   "The third party folder to write rules to",
+				Value:   plzconfig.DefaultThirdPartyDir,
+				Usage:   "The third party folder to write rules to, relative to the repo root. Defaults to go-deps-third-party-dir in the [buildconfig] section of .plzconfig",
+			},
+			&cli.StringFlag{
+				Name:  layoutFlag,
+				Usage: "Which BUILD files to put rules in, one of single, per-host, per-org or per-module. Defaults to go-deps-layout in the [buildconfig] section of .plzconfig, or per-org",
+			},
+			&cli.StringFlag{
+				Name:  rulesFlag,
+				Usage: "The rules to generate, one of go_module, go_mod_download (a go_mod_download and go_module for every module) or go_repo. Defaults to go-deps-rules in the [buildconfig] section of .plzconfig, or go_module",
+			},
+			&cli.StringFlag{
+				Name:  platformFlag,
+				Usage: "The platform to apply build constraints for when working out which packages to install, as os_arch. Defaults to go-deps-platform in the [buildconfig] section of .plzconfig, or linux_amd64",
+			},
+			&cli.StringSliceFlag{
+				Name:  profileFlag,
+				Usage: "Also read the .plzconfig.<profile> config file, as with plz --profile",
+				EnvVars: []string{"PLZ_CONFIG_PROFILE"},
+			},
+			&cli.IntFlag{
+				Name:    jobsFlag,
+				Aliases: []string{"j"},
+				Value:   module.DefaultJobs,
+				Usage:   "Number of modules to download at once",
 			},
 		},
-		Action: func(ctx *cli.Context) error {
-			fmt.Println("Please Go Get v0.0.1")
-
-			alreadyExists, err := host.CreateGoMod(ctx.Context)
+		Before: func(ctx *cli.Context) error {
+			var err error
+			workDir, err = os.Getwd()
 			if err != nil {
-				return err
+				return fmt.Errorf("unable to determine working directory: %w", err)
 			}
-			if !alreadyExists {
-				defer host.TearDownGoMod(ctx.Context)
+			config, err = plzconfig.Load(workDir, ctx.StringSlice(profileFlag)...)
+			if err != nil {
+				return err
 			}
+			// Everything from here on is relative to the repo root, as it is for plz.
+			return os.Chdir(config.Root)
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "migrate",
+				Usage:     "Convert the deprecated go_get rules in the repo into go_module rules",
+				ArgsUsage: "[directories to search, defaults to the current directory]",
+				Action: func(ctx *cli.Context) error {
+					proxy, err := newProxy()
+					if err != nil {
+						return err
+					}
+					var writer module.Writer = module.FileWriter{}
+					if ctx.Bool(dryRunFlag) {
+						writer = &module.DiffWriter{Out: os.Stdout}
+					}
+					dirs := ctx.Args().Slice()
+					if len(dirs) == 0 {
+						dirs = []string{"."}
+					}
+					for _, dir := range dirs {
+						err := module.MigrateGoGetRules(ctx.Context, proxy, writer, fromWorkDir(dir))
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "check",
+				Usage: "Check that the third party BUILD files are what we would generate, and that every module matches the hashes in its rule, for use in CI",
+				Action: func(ctx *cli.Context) error {
+					resolver, mods, err := newResolver(ctx, module.FileWriter{})
+					if err != nil {
+						return err
+					}
+					err = resolver.Resolve(ctx.Context, mods...)
+					if err != nil {
+						return err
+					}
+					problems, err := resolver.Directory().Check()
+					if err != nil {
+						return err
+					}
+					module.PrintProblems(os.Stdout, problems)
+					if len(problems) > 0 {
+						return fmt.Errorf("third party modules are out of date, run go-deps to update them")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "upgrade",
+				Usage:     "Upgrade modules already in the third party directory, along with anything they need",
+				ArgsUsage: "[modules to upgrade]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  allFlag,
+						Usage: "Upgrade every module in the third party directory",
+					},
+					&cli.BoolFlag{
+						Name:  minorFlag,
+						Usage: "Only upgrade to versions with the same major version",
+					},
+					&cli.BoolFlag{
+						Name:  patchFlag,
+						Usage: "Only upgrade to versions with the same major and minor version",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					paths := ctx.Args().Slice()
+					if ctx.Bool(allFlag) == (len(paths) > 0) {
+						return fmt.Errorf("Either give the modules to upgrade or %q", allFlag)
+					}
+					policy := module.UpgradeLatest
+					switch {
+					case ctx.Bool(minorFlag) && ctx.Bool(patchFlag):
+						return fmt.Errorf("Only one of %q or %q can be set", minorFlag, patchFlag)
+					case ctx.Bool(minorFlag):
+						policy = module.UpgradeMinor
+					case ctx.Bool(patchFlag):
+						policy = module.UpgradePatch
+					}
+
+					var writer module.Writer = module.FileWriter{}
+					if ctx.Bool(dryRunFlag) {
+						writer = &module.DiffWriter{Out: os.Stdout}
+					}
+					resolver, mods, err := newResolver(ctx, writer)
+					if err != nil {
+						return err
+					}
+					err = resolver.Upgrade(ctx.Context, policy, paths...)
+					if err != nil {
+						return err
+					}
+					err = resolver.Resolve(ctx.Context, mods...)
+					if err != nil {
+						return err
+					}
+					err = resolver.Write()
+					if err != nil {
+						return err
+					}
+					return resolver.Directory().PrintVersionTable(os.Stdout)
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "Remove modules from the third party directory, along with any dependencies nothing else needs",
+				ArgsUsage: "[modules to remove]",
+				Action: func(ctx *cli.Context) error {
+					paths := ctx.Args().Slice()
+					if len(paths) == 0 {
+						return fmt.Errorf("No modules to remove were given")
+					}
+
+					var writer module.Writer = module.FileWriter{}
+					if ctx.Bool(dryRunFlag) {
+						writer = &module.DiffWriter{Out: os.Stdout}
+					}
+					resolver, _, err := newResolver(ctx, writer)
+					if err != nil {
+						return err
+					}
+					removed, err := resolver.Remove(paths...)
+					if err != nil {
+						return err
+					}
+					err = resolver.Write()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Removed %d modules:\n", len(removed))
+					for _, mod := range removed {
+						fmt.Printf("\t%s\n", mod.String())
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "move",
+				Usage: "Move the rules in the third party directory to where --layout puts them, updating every reference to them in the repo",
+				Action: func(ctx *cli.Context) error {
+					var writer module.Writer = module.FileWriter{}
+					if ctx.Bool(dryRunFlag) {
+						writer = &module.DiffWriter{Out: os.Stdout}
+					}
+					resolver, mods, err := newResolver(ctx, writer)
+					if err != nil {
+						return err
+					}
+					moved := resolver.Move()
+					if len(moved) == 0 {
+						fmt.Println("Everything is already where it should be")
+						return nil
+					}
+					err = resolver.Resolve(ctx.Context, mods...)
+					if err != nil {
+						return err
+					}
+					err = resolver.Write()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Moved %d modules:\n", len(moved))
+					for _, mod := range moved {
+						fmt.Printf("\t%s\n", mod.GetFullyQualifiedName())
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "why",
+				Usage:     "Explain why modules are needed, and why they are at the versions they're at",
+				ArgsUsage: "[modules to explain]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  jsonFlag,
+						Usage: "Print the explanations as JSON",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					paths := ctx.Args().Slice()
+					if len(paths) == 0 {
+						return fmt.Errorf("No modules to explain were given")
+					}
+					resolver, mods, err := newResolver(ctx, module.FileWriter{})
+					if err != nil {
+						return err
+					}
+					err = resolver.Resolve(ctx.Context, mods...)
+					if err != nil {
+						return err
+					}
 
-			m := &module.Module{
-				Path: ctx.String(moduleFlag),
-				Version: ctx.String(versionFlag),
+					explanations := make([]*module.Explanation, 0, len(paths))
+					for _, path := range paths {
+						explanation, err := resolver.Directory().Why(path)
+						if err != nil {
+							return err
+						}
+						explanations = append(explanations, explanation)
+					}
+					if ctx.Bool(jsonFlag) {
+						encoder := json.NewEncoder(os.Stdout)
+						encoder.SetIndent("", "  ")
+						return encoder.Encode(explanations)
+					}
+					for i, explanation := range explanations {
+						if i > 0 {
+							fmt.Println()
+						}
+						explanation.Print(os.Stdout)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "graph",
+				Usage: "Print the resolved module graph, clustered by BUILD file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  formatFlag,
+						Value: module.FormatDOT,
+						Usage: "The format to print the graph in, one of dot, json or mermaid",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					resolver, mods, err := newResolver(ctx, module.FileWriter{})
+					if err != nil {
+						return err
+					}
+					err = resolver.Resolve(ctx.Context, mods...)
+					if err != nil {
+						return err
+					}
+					return resolver.Directory().Export(os.Stdout, ctx.String(formatFlag))
+				},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if !ctx.IsSet(moduleFlag) && !ctx.IsSet(fromGoModFlag) {
+				return fmt.Errorf("One of %q or %q must be set", moduleFlag, fromGoModFlag)
 			}
 
-			fmt.Printf("So, you want to add %q?\n", m.String())
+			fmt.Println("Please Go Get v0.0.1")
 
-			err = m.Download(ctx.Context)
+			var writer module.Writer = module.FileWriter{}
+			if ctx.Bool(dryRunFlag) {
+				writer = &module.DiffWriter{Out: os.Stdout}
+			}
+			resolver, mods, err := newResolver(ctx, writer)
 			if err != nil {
 				return err
 			}
 
-			_, err = m.GetDependenciesRecursively(ctx.Context)
+			for _, m := range mods {
+				fmt.Printf("So, you want to add %q?\n", m.String())
+			}
+
+			err = resolver.Resolve(ctx.Context, mods...)
 			if err != nil {
 				return err
 			}
 
-			module.GlobalCache.Sync()
-			module.GlobalCache.Print()
+			if ctx.Bool(dryRunFlag) {
+				err = resolver.Write()
+				if err != nil {
+					return err
+				}
+				resolver.Directory().PrintChanges(os.Stdout)
+				return nil
+			}
+
+			resolver.Directory().Print()
 
-			return module.GlobalCache.ExportBuildRules(ctx.String(thirdPartyFlag))
+			return resolver.Write()
 		},
 	}
 
@@ -81,3 +407,133 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// newResolver sets up a resolver from the flags, loading the existing modules from the third
+// party directory, and returns it along with the modules we have been asked to add.
+func newResolver(ctx *cli.Context, writer module.Writer) (*module.Resolver, []*module.Module, error) {
+	proxy, err := newProxy()
+	if err != nil {
+		return nil, nil, err
+	}
+	thirdParty := config.ThirdPartyDir
+	if ctx.IsSet(thirdPartyFlag) {
+		thirdParty = ctx.String(thirdPartyFlag)
+	}
+	resolver := module.NewResolver(thirdParty, proxy, writer)
+	resolver.Directory().Jobs = ctx.Int(jobsFlag)
+	resolver.Directory().ImportPath = config.ImportPath
+	layout := config.Layout
+	if ctx.IsSet(layoutFlag) {
+		layout = ctx.String(layoutFlag)
+	}
+	if layout != "" {
+		resolver.Directory().Layout, err = module.ParseLayout(layout)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	rules := config.Rules
+	if ctx.IsSet(rulesFlag) {
+		rules = ctx.String(rulesFlag)
+	}
+	if rules != "" {
+		resolver.Directory().Emitter, err = module.ParseEmitter(rules)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	platform := config.Platform
+	if ctx.IsSet(platformFlag) {
+		platform = ctx.String(platformFlag)
+	}
+	if platform != "" {
+		resolver.Directory().Platform, err = module.ParsePlatform(platform)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, name := range ctx.StringSlice(nameFlag) {
+		i := strings.Index(name, "=")
+		if i < 0 {
+			return nil, nil, fmt.Errorf("%q should be in path=name form", name)
+		}
+		err = resolver.Directory().SetName(name[:i], name[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = resolver.LoadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = resolver.LoadLock(ctx.Bool(updateFlag))
+	if err != nil {
+		return nil, nil, err
+	}
+	err = resolver.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mods, err := parseModules(ctx.StringSlice(moduleFlag), ctx.String(versionFlag))
+	if err != nil {
+		return nil, nil, err
+	}
+	if ctx.IsSet(goSumFlag) {
+		err = resolver.LoadGoSum(fromWorkDir(ctx.String(goSumFlag)))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if ctx.IsSet(fromGoModFlag) {
+		required, err := resolver.LoadGoMod(fromWorkDir(ctx.String(fromGoModFlag)))
+		if err != nil {
+			return nil, nil, err
+		}
+		mods = append(mods, required...)
+	}
+	return resolver, mods, nil
+}
+
+// newProxy returns the proxy configured by the environment, using the go tool from .plzconfig
+// to fetch modules directly if we're able to run it.
+func newProxy() (*host.Proxy, error) {
+	proxy, err := host.DefaultProxy()
+	if err != nil {
+		return nil, err
+	}
+	if goTool, ok := config.GoToolPath(); ok {
+		proxy.WithGoTool(goTool)
+	}
+	return proxy, nil
+}
+
+// fromWorkDir returns the path relative to the directory we were run from, as we move to the
+// repo root before doing anything.
+func fromWorkDir(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workDir, path)
+}
+
+// parseModules parses the modules given on the command line, in path or path@version form.
+// The version flag is only allowed when a single module is given.
+func parseModules(args []string, version string) ([]*module.Module, error) {
+	if version != "" && len(args) != 1 {
+		return nil, fmt.Errorf("%q can only be used when adding a single module, use path@version instead", versionFlag)
+	}
+	mods := make([]*module.Module, 0, len(args))
+	for _, arg := range args {
+		m := &module.Module{Path: arg, Version: version}
+		if i := strings.Index(arg, "@"); i >= 0 {
+			if version != "" {
+				return nil, fmt.Errorf("%s already has a version, can't use %q too", arg, versionFlag)
+			}
+			m.Path, m.Version = arg[:i], arg[i+1:]
+		}
+		mods = append(mods, m)
+	}
+	return mods, nil
+}
@@ -0,0 +1,153 @@
+package module
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Problem is a difference between the rules on disk and the rules we would generate. Problems
+// with a particular module have Module set, and otherwise Path is the BUILD file that differs,
+// with Diff showing how.
+type Problem struct {
+	Module *Module
+	Path   string
+	Reason string
+	Diff   string
+}
+
+// String returns a readable description of the problem.
+func (p Problem) String() string {
+	if p.Module == nil {
+		return fmt.Sprintf("%s: %s", p.Path, p.Reason)
+	}
+	return fmt.Sprintf("%s: %s", p.Module.GetFullyQualifiedName(), p.Reason)
+}
+
+// Check compares the rules already on disk with the rules we would generate for the resolved
+// modules. Any modules that are missing, at the wrong version, or have out of date deps are
+// returned first, sorted by module path, followed by every BUILD file that isn't exactly what
+// we would write, so hand edits to anything else in the rules are caught too, and lastly the
+// lock file if it's out of date. Every module has
+// been downloaded and checked against the hashes in its rule by Resolve, so a mismatch fails
+// before we get here.
+func (d *Directory) Check() ([]Problem, error) {
+	problems := []Problem{}
+	for _, mod := range d.Modules() {
+		switch mod.existingVersion {
+		case "":
+			problems = append(problems, Problem{
+				Module: mod,
+				Reason: fmt.Sprintf("missing, %s is needed", mod.String()),
+			})
+			continue
+		case mod.GetDownloadVersion():
+		default:
+			problems = append(problems, Problem{
+				Module: mod,
+				Reason: fmt.Sprintf("at version %s, but %s is needed", mod.existingVersion, mod.GetDownloadVersion()),
+			})
+			continue
+		}
+
+		missing, extra := diffDeps(mod)
+		if len(missing) == 0 && len(extra) == 0 {
+			continue
+		}
+		reasons := []string{}
+		if len(missing) > 0 {
+			reasons = append(reasons, "missing deps "+strings.Join(missing, ", "))
+		}
+		if len(extra) > 0 {
+			reasons = append(reasons, "unneeded deps "+strings.Join(extra, ", "))
+		}
+		problems = append(problems, Problem{
+			Module: mod,
+			Reason: strings.Join(reasons, "; "),
+		})
+	}
+
+	writer := &checkWriter{}
+	err := d.ExportBuildRules(writer)
+	if err != nil {
+		return nil, err
+	}
+	err = d.WriteLock(writer)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, writer.problems...), nil
+}
+
+// checkWriter is a Writer that doesn't write anything, but records a problem for every file
+// that would change.
+type checkWriter struct {
+	problems []Problem
+}
+
+// WriteFile records a problem if data isn't what's in the file on disk.
+func (w *checkWriter) WriteFile(path string, data []byte) error {
+	diff, err := diffFile(path, data)
+	if err != nil || diff == "" {
+		return err
+	}
+	w.problems = append(w.problems, Problem{Path: path, Reason: "isn't what go-deps would generate", Diff: diff})
+	return nil
+}
+
+// RemoveFile records a problem for the file on disk, as it shouldn't be there.
+func (w *checkWriter) RemoveFile(path string) error {
+	diff, err := diffRemoval(path)
+	if err != nil {
+		return err
+	}
+	w.problems = append(w.problems, Problem{Path: path, Reason: "should be removed", Diff: diff})
+	return nil
+}
+
+// diffDeps returns the deps the module's rule on disk is missing, and the deps it has that
+// it doesn't need. Extra deps from the module's config are always wanted.
+func diffDeps(mod *Module) (missing, extra []string) {
+	deps := make([]string, 0, len(mod.Deps))
+	for _, dep := range mod.Deps {
+		deps = append(deps, dep.GetFullyQualifiedName())
+	}
+	want := []string{}
+	wanted := map[string]struct{}{}
+	for _, dep := range append(deps, mod.configDeps()...) {
+		if _, ok := wanted[dep]; !ok {
+			wanted[dep] = struct{}{}
+			want = append(want, dep)
+		}
+	}
+	have := map[string]struct{}{}
+	for _, dep := range mod.existingDeps {
+		have[dep] = struct{}{}
+		if _, ok := wanted[dep]; !ok {
+			extra = append(extra, dep)
+		}
+	}
+	for _, dep := range want {
+		if _, ok := have[dep]; !ok {
+			missing = append(missing, dep)
+		}
+	}
+	return missing, extra
+}
+
+// PrintProblems prints a report of the problems found by Check.
+func PrintProblems(w io.Writer, problems []Problem) {
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "Everything is up to date")
+		return
+	}
+	fmt.Fprintf(w, "Found %d problems with the third party rules:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(w, "\t%s\n", problem.String())
+	}
+	for _, problem := range problems {
+		if problem.Diff != "" {
+			fmt.Fprint(w, problem.Diff)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/bazelbuild/buildtools/build"
+	"golang.org/x/mod/semver"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileName is the name of the file in the third party directory with the overrides for
+// modules that need special handling.
+const ConfigFileName = "go-deps.yaml"
+
+// ModuleConfig is the overrides for a module, which are applied every time its rules are
+// generated, so that hand fixes aren't lost.
+type ModuleConfig struct {
+	// Install is the packages to install, instead of the ones we work out.
+	Install []string `yaml:"install"`
+	// Deps are extra deps for the module's rule, on top of the ones its go.mod asks for.
+	Deps []string `yaml:"deps"`
+	// Strip are the paths to remove from the module once it has been downloaded.
+	Strip []string `yaml:"strip"`
+	// Version pins the version of the module that gets downloaded, in the same way as a
+	// replace directive would.
+	Version string `yaml:"version"`
+	// Visibility is the visibility of the module's rules, instead of PUBLIC.
+	Visibility []string `yaml:"visibility"`
+	// Patch is a patch file to apply to the module once it has been downloaded.
+	Patch string `yaml:"patch"`
+}
+
+// LoadConfig reads the module config file at path, if there is one, and applies it to the
+// modules in the directory, along with any that get added to it later.
+func (d *Directory) LoadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read module config: %w", err)
+	}
+
+	configs := map[string]*ModuleConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&configs); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse module config %s: %w", path, err)
+	}
+
+	modPaths := make([]string, 0, len(configs))
+	for modPath := range configs {
+		modPaths = append(modPaths, modPath)
+	}
+	sort.Strings(modPaths)
+	for _, modPath := range modPaths {
+		config := configs[modPath]
+		if config == nil {
+			continue
+		}
+		if config.Version != "" {
+			if !semver.IsValid(config.Version) {
+				return fmt.Errorf("%s: %s is pinned to %q, which isn't a valid version", path, modPath, config.Version)
+			}
+			pin := Replacement{OldPath: modPath, NewPath: modPath, NewVersion: config.Version}
+			if existing, ok := d.replacements[replacementKey(modPath, "")]; ok && existing != pin {
+				return fmt.Errorf("conflicting replacements for %s: %s and %s", modPath, existing, pin)
+			}
+			d.replacements[replacementKey(modPath, "")] = pin
+		}
+		d.config[modPath] = config
+		if vd := d.Get(modPath); vd != nil {
+			for _, mod := range vd.versions {
+				mod.applyConfig(config)
+			}
+		}
+	}
+	log.Printf("Loaded the config for %d modules from %s\n", len(d.config), path)
+	return nil
+}
+
+// applyConfig attaches the config to the module. Its install list is used instead of
+// whatever is on disk, and we never work out the packages for it ourselves.
+func (m *Module) applyConfig(config *ModuleConfig) {
+	m.config = config
+	if len(config.Install) > 0 {
+		m.Install = config.Install
+	}
+}
+
+// GetVisibility returns the visibility of the module's rules, defaulting to PUBLIC.
+func (m *Module) GetVisibility() []string {
+	if m.config != nil && len(m.config.Visibility) > 0 {
+		return m.config.Visibility
+	}
+	return []string{"PUBLIC"}
+}
+
+// configDeps returns the fully qualified labels of the extra deps from the module's config.
+func (m *Module) configDeps() []string {
+	if m.config == nil {
+		return nil
+	}
+	labels := make([]string, 0, len(m.config.Deps))
+	for _, dep := range m.config.Deps {
+		labels = append(labels, canonicalLabel(dep, m.buildPackage()))
+	}
+	return labels
+}
+
+// setDownloadConfig sets the attributes from the module's config that change what gets
+// downloaded on the rule that downloads it.
+func setDownloadConfig(rule *build.Rule, mod *Module) {
+	if mod.config == nil {
+		return
+	}
+	setStrings(rule, "strip", mod.config.Strip)
+	setString(rule, "patch", mod.config.Patch)
+}
@@ -0,0 +1,72 @@
+package module
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), map[string]string{
+		"third_party/go/example.com/BUILD": moduleRule("foo", "example.com/foo", "v1.0.0"),
+		"third_party/go/go-deps.yaml": `example.com/foo:
+  install: [cmd/foo]
+  deps: ["//third_party/cc:zlib", ":bar"]
+  visibility: ["//app/..."]
+example.com/bar:
+  version: v1.2.3
+`,
+	})
+
+	foo := d.Get("example.com/foo").existing()
+	if want := []string{"cmd/foo"}; !reflect.DeepEqual(foo.GetInstall(), want) {
+		t.Errorf("foo installs %v, want %v", foo.GetInstall(), want)
+	}
+	if want := []string{"//third_party/cc:zlib", "//third_party/go/example.com:bar"}; !reflect.DeepEqual(foo.configDeps(), want) {
+		t.Errorf("foo config deps = %v, want %v", foo.configDeps(), want)
+	}
+	if want := []string{"//app/..."}; !reflect.DeepEqual(foo.GetVisibility(), want) {
+		t.Errorf("foo visibility = %v, want %v", foo.GetVisibility(), want)
+	}
+	// Modules added later get their config too, and pins work like replace directives.
+	bar := d.SetModule(parseModule("example.com/bar@v1.0.0"))
+	if bar.config == nil {
+		t.Errorf("bar wasn't given its config when it was added")
+	}
+	if rep, ok := d.replacement(bar); !ok || rep.NewVersion != "v1.2.3" {
+		t.Errorf("bar replacement = %v, %v, want it pinned to v1.2.3", rep, ok)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name:   "unknown key",
+			config: "example.com/foo:\n  instal: [cmd/foo]\n",
+			want:   "field instal not found",
+		},
+		{
+			name:   "invalid version",
+			config: "example.com/foo:\n  version: latest\n",
+			want:   `example.com/foo is pinned to "latest", which isn't a valid version`,
+		},
+		{
+			name:   "not a map of modules",
+			config: "- example.com/foo\n",
+			want:   "failed to parse module config",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inRepo(t, map[string]string{"third_party/go/go-deps.yaml": test.config})
+			err := NewResolver("third_party/go", newFakeFetcher(), FileWriter{}).LoadConfig()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
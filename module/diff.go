@@ -0,0 +1,294 @@
+package module
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change in a diff.
+const diffContext = 3
+
+// maxDiffCells limits how much work we'll do to find the smallest diff. Past this, the
+// changed lines are just shown as removed and added in one go.
+const maxDiffCells = 4 << 20
+
+// DiffWriter is a Writer that doesn't write anything, but prints a unified diff of how
+// each file would change instead.
+type DiffWriter struct {
+	Out io.Writer
+	// Changed is the paths of the files that would have changed.
+	Changed []string
+}
+
+// WriteFile prints the diff between the file on disk and data.
+func (w *DiffWriter) WriteFile(path string, data []byte) error {
+	diff, err := diffFile(path, data)
+	if err != nil || diff == "" {
+		return err
+	}
+	w.Changed = append(w.Changed, path)
+	_, err = io.WriteString(w.Out, diff)
+	return err
+}
+
+// RemoveFile prints the diff of removing the file on disk.
+func (w *DiffWriter) RemoveFile(path string) error {
+	diff, err := diffRemoval(path)
+	if err != nil {
+		return err
+	}
+	w.Changed = append(w.Changed, path)
+	_, err = io.WriteString(w.Out, diff)
+	return err
+}
+
+// diffFile returns the unified diff between the file on disk and data, which is empty if they
+// are the same.
+func diffFile(path string, data []byte) (string, error) {
+	oldName := "a/" + path
+	old, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read build file: %w", err)
+	}
+	return unifiedDiff(oldName, "b/"+path, string(old), string(data)), nil
+}
+
+// diffRemoval returns the unified diff of removing the file on disk.
+func diffRemoval(path string) (string, error) {
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read build file: %w", err)
+	}
+	return unifiedDiff("a/"+path, "/dev/null", string(old), ""), nil
+}
+
+// Change is a module that will be added, removed or changed by writing the directory out.
+type Change struct {
+	Path string
+	// OldVersion is the version already on disk, or "" if the module is being added.
+	OldVersion string
+	// NewVersion is the version that will be written, or "" if the module is being removed.
+	NewVersion string
+}
+
+// Changes returns the modules whose version on disk differs from what is going to be
+// written, sorted by module path.
+func (d *Directory) Changes() []Change {
+	selected := map[string]*Module{}
+	for _, mod := range d.Modules() {
+		selected[mod.Path] = mod
+	}
+
+	changes := []Change{}
+	for _, path := range d.paths() {
+		change := Change{
+			Path:       path,
+			OldVersion: d.modules[path].existingVersion(),
+		}
+		if mod, ok := selected[path]; ok {
+			change.NewVersion = mod.GetDownloadVersion()
+		}
+		if change.OldVersion != change.NewVersion {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// PrintChanges prints a summary of the modules that are added, removed or changed.
+func (d *Directory) PrintChanges(w io.Writer) {
+	var added, removed, changed []string
+	for _, change := range d.Changes() {
+		switch {
+		case change.OldVersion == "":
+			added = append(added, fmt.Sprintf("\t%s@%s\n", change.Path, change.NewVersion))
+		case change.NewVersion == "":
+			removed = append(removed, fmt.Sprintf("\t%s@%s\n", change.Path, change.OldVersion))
+		default:
+			changed = append(changed, fmt.Sprintf("\t%s %s --> %s\n", change.Path, change.OldVersion, change.NewVersion))
+		}
+	}
+
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(added), len(removed), len(changed))
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{{"Added", added}, {"Removed", removed}, {"Changed", changed}} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n%s", section.title, strings.Join(section.lines, ""))
+	}
+}
+
+// diffOp is a single line of a diff, ' ' for unchanged, '-' for removed or '+' for added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff between the old and new text, or "" if they're the same.
+func unifiedDiff(oldName, newName, old, new string) string {
+	if old == new {
+		return ""
+	}
+	ops := diffLines(splitLines(old), splitLines(new))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(ops); {
+		// Find the next change, and include the context before it.
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		if start -= diffContext; start < 0 {
+			start = 0
+		}
+
+		// Carry on until there are more than two lots of context without any changes.
+		end, unchanged := start, 0
+		for ; end < len(ops) && unchanged <= 2*diffContext; end++ {
+			if ops[end].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		if unchanged > diffContext {
+			end -= unchanged - diffContext
+		}
+
+		writeHunk(&out, ops, start, end)
+		start = end
+	}
+	return out.String()
+}
+
+// writeHunk writes the hunk of ops between start and end.
+func writeHunk(out *strings.Builder, ops []diffOp, start, end int) {
+	oldStart, newStart := 1, 1
+	for _, op := range ops[:start] {
+		if op.kind != '+' {
+			oldStart++
+		}
+		if op.kind != '-' {
+			newStart++
+		}
+	}
+	oldLines, newLines := 0, 0
+	for _, op := range ops[start:end] {
+		if op.kind != '+' {
+			oldLines++
+		}
+		if op.kind != '-' {
+			newLines++
+		}
+	}
+	// Empty ranges start at the line before, as diff does.
+	if oldLines == 0 {
+		oldStart--
+	}
+	if newLines == 0 {
+		newStart--
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldLines, newStart, newLines)
+	for _, op := range ops[start:end] {
+		out.WriteByte(op.kind)
+		out.WriteString(op.line)
+		out.WriteByte('\n')
+	}
+}
+
+// diffLines returns the edits to turn the old lines into the new lines, using the longest
+// common subsequence of the lines that differ.
+func diffLines(old, new []string) []diffOp {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(old)+len(new))
+	for _, line := range old[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, diffMiddle(old[prefix:len(old)-suffix], new[prefix:len(new)-suffix])...)
+	for _, line := range old[len(old)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// diffMiddle diffs the lines between the common prefix and suffix.
+func diffMiddle(old, new []string) []diffOp {
+	ops := make([]diffOp, 0, len(old)+len(new))
+	if len(old)*len(new) > maxDiffCells {
+		for _, line := range old {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range new {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of old[i:] and new[j:].
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			ops = append(ops, diffOp{' ', old[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', old[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', new[j]})
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		ops = append(ops, diffOp{'-', old[i]})
+	}
+	for ; j < len(new); j++ {
+		ops = append(ops, diffOp{'+', new[j]})
+	}
+	return ops
+}
+
+// splitLines splits the text into lines, without their line endings.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -1,127 +1,771 @@
 package module
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 
-	"github.com/jamesjarvis/go-deps/host"
+	"github.com/jamesjarvis/go-deps/buildfile"
 	"golang.org/x/mod/semver"
 )
 
-var GlobalCache *Directory
+// Directory will be the cache of seen modules, it will be responsible for storing the
+// module requirement graph and ultimately resolving module version clashes.
+type Directory struct {
+	// Jobs is the number of modules to fetch at once.
+	Jobs int
+	// ImportPath is the import path of the repo itself. Modules under it are part of the
+	// repo, so they are never added to the third party directory.
+	ImportPath string
+	// Layout decides which BUILD files new rules go in. Defaults to LayoutPerOrg.
+	Layout Layout
+	// Emitter produces the rules that are written for each module. Defaults to GoModuleEmitter.
+	Emitter Emitter
+	// Platform is the platform build constraints are applied for when working out which
+	// packages of each module to install. Defaults to DefaultPlatform.
+	Platform Platform
 
-func init() {
-	// I know this is kinda dirty code but I couldn't be bothered to
-	// think about this too hard for the initial implementation....
-	GlobalCache = NewDirectory()
+	// thirdParty is the third party directory, relative to the repo root.
+	thirdParty string
+	fetcher    Fetcher
+	modules    map[string]*VersionDirectory
+	roots      []*Module
+	// upgrades are the new minimum versions of existing modules picked by Upgrade.
+	upgrades []*Module
+	// removed are the modules on disk being removed by Remove, keyed by path, and moved are
+	// where the rules of the modules being moved by Move were.
+	removed map[string]*Module
+	moved   map[string]movedRule
+	// locked are the versions of the modules in the lock file, and lockedRoots are the paths
+	// of the roots in it.
+	locked      map[string]string
+	lockedRoots map[string]struct{}
+	// lockedInferred are the paths of the inferred requirements of each module in the lock
+	// file, which are kept as they are until the modules are resolved again.
+	lockedInferred map[string][]string
+	// resolved is set once Resolve has selected the versions of everything.
+	resolved bool
+	// replacements and excluded hold the replace and exclude directives of the main module, and
+	// lockedReplacements are the replacements of the modules on disk, keyed by module path,
+	// which still apply when the main module isn't around to tell us about them.
+	replacements       map[string]Replacement
+	lockedReplacements map[string]Replacement
+	excluded           map[string]struct{}
+	// sums are the known go.sum style hashes of modules, keyed in the same way as go.sum.
+	sums map[string]string
+	// mainModule is set when we have been given the go.mod of the main module, in which case
+	// the roots are just its requirements.
+	mainModule *Module
+	// unresolvable is the set of import paths we couldn't find a module for.
+	unresolvable map[string]struct{}
+	// names are the names given to new modules' rules, keyed by module path, and ruleNames
+	// are the names of the rules already on disk in each package, along with the module path
+	// of each rule generated for a module.
+	names     map[string]string
+	ruleNames map[string]map[string]string
+	// config is the overrides from the module config file, keyed by module path.
+	config map[string]*ModuleConfig
 }
 
-// Directory will be the global cache of seen modules, it will be responsible
-// for storing modules and ultimately resolving module version clashes.
-type Directory struct {
-	modules map[string]*VersionDirectory
+// NewDirectory returns an empty directory for the third party directory, which fetches
+// modules with the fetcher.
+func NewDirectory(thirdParty string, fetcher Fetcher) *Directory {
+	return &Directory{
+		Jobs:               DefaultJobs,
+		Platform:           DefaultPlatform,
+		thirdParty:         thirdParty,
+		fetcher:            fetcher,
+		modules:            map[string]*VersionDirectory{},
+		replacements:       map[string]Replacement{},
+		lockedReplacements: map[string]Replacement{},
+		excluded:           map[string]struct{}{},
+		sums:               map[string]string{},
+		removed:            map[string]*Module{},
+		moved:              map[string]movedRule{},
+		locked:             map[string]string{},
+		lockedRoots:        map[string]struct{}{},
+		lockedInferred:     map[string][]string{},
+		unresolvable:       map[string]struct{}{},
+		names:              map[string]string{},
+		ruleNames:          map[string]map[string]string{},
+		config:             map[string]*ModuleConfig{},
+	}
 }
 
-func NewDirectory() *Directory {
-	return &Directory{
-		modules: map[string]*VersionDirectory{},
+// Resolve works out the versions of the root modules and all of their dependencies.
+// This happens in four steps:
+//  1. Load the requirement graph, by fetching the go.mod of every module version in it. This
+//     is pruned below modules that say go 1.17 or later, the same way go prunes it.
+//  2. Compute the build list from that graph using Minimal Version Selection.
+//  3. Download the selected module versions. Any of them without a go.mod file have their
+//     requirements inferred from their imports, in which case we start again from step 1.
+//  4. Work out which packages of the selected modules we need, and fill in the deps of
+//     any that we had to infer requirements for.
+//
+// Any modules loaded from existing BUILD files act as minimum versions, in the same way that
+// requirements in the main module's go.mod would.
+func (d *Directory) Resolve(ctx context.Context, roots ...*Module) error {
+	for _, root := range roots {
+		if d.inRepo(root.Path) {
+			return fmt.Errorf("%s is part of this repo, so can't be added to the third party directory", root.Path)
+		}
+		if version, ok := d.locked[root.Path]; ok && (root.Version == "" || root.Version == "latest") {
+			log.Printf("Using %s@%s from the lock file\n", root.Path, version)
+			root.Version = version
+		}
+		if config, ok := d.config[root.Path]; ok && config.Version != "" && root.Version != config.Version {
+			// Roots are main modules, which replacements don't apply to, so just use the pin.
+			log.Printf("Using %s@%s as it is pinned in the module config\n", root.Path, config.Version)
+			root.Version = config.Version
+		}
+		if !semver.IsValid(root.Version) {
+			// We need a canonical version to work with, so resolve any queries first.
+			err := root.Download(ctx, d.fetcher)
+			if err != nil {
+				return err
+			}
+			err = d.verify(root)
+			if err != nil {
+				return err
+			}
+		}
+		root = d.SetModule(root)
+		d.roots = append(d.roots, root)
+
+		if d.mainModule != nil {
+			continue
+		}
+		// Otherwise the roots are our main modules, so their replace and exclude directives apply.
+		err := root.fetchRequirements(ctx, d.fetcher)
+		if err != nil {
+			return err
+		}
+		err = d.AddMainModuleDirectives(root)
+		if err != nil {
+			return err
+		}
+	}
+	mains, minimums, err := d.graphTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := d.loadGraph(ctx, mains, minimums)
+		if err != nil {
+			return err
+		}
+
+		buildList, err := BuildList(mains, minimums, d.requirements)
+		if err != nil {
+			return err
+		}
+		if d.mainModule != nil {
+			buildList = without(buildList, d.mainModule)
+		}
+		// The graph may have been pruned below some of the selected modules, but we still
+		// need their requirements to work out their deps.
+		unloaded := []*Module{}
+		for _, mod := range buildList {
+			if mod.requires == nil {
+				unloaded = append(unloaded, mod)
+			}
+		}
+		err = d.fetchAll(ctx, unloaded, d.loadRequirements, nil)
+		if err != nil {
+			return err
+		}
+		d.selectVersions(buildList)
+
+		err = d.downloadSelected(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Modules without a go.mod don't declare their requirements, so we have to work
+		// them out from their imports, and go round again if that finds anything new.
+		inferred, err := d.inferRequirements(ctx)
+		if err != nil {
+			return err
+		}
+		if !inferred {
+			break
+		}
+	}
+	err = d.computeInstalls()
+	if err != nil {
+		return err
+	}
+	err = d.inferInstalledDeps()
+	if err != nil {
+		return err
+	}
+	err = d.assignNames()
+	if err != nil {
+		return err
+	}
+	d.resolved = true
+	return nil
+}
+
+// graphTargets returns the modules the requirement graph is built from. The main modules are
+// the roots and upgrades, or the main module itself if we have its go.mod, in which case the
+// roots and upgrades are its requirements. The rest of the modules from existing BUILD files
+// only act as minimum versions, as anything they pulled in to the graph is on disk too.
+func (d *Directory) graphTargets(ctx context.Context) (mains, minimums []*Module, err error) {
+	isMain := map[*Module]struct{}{}
+	for _, mod := range append(d.Roots(), d.upgrades...) {
+		isMain[mod] = struct{}{}
+		mod, err := d.allowedVersion(ctx, mod)
+		if err != nil {
+			return nil, nil, err
+		}
+		mains = append(mains, mod)
+	}
+	if d.mainModule != nil {
+		d.mainModule.requires = make([]Requirement, 0, len(mains))
+		for _, mod := range mains {
+			d.mainModule.requires = append(d.mainModule.requires, Requirement{Path: mod.Path, Version: mod.Version})
+		}
+		mains = []*Module{d.mainModule}
+	}
+
+	for _, mod := range d.targets() {
+		if _, ok := isMain[mod]; ok {
+			continue
+		}
+		mod, err := d.allowedVersion(ctx, mod)
+		if err != nil {
+			return nil, nil, err
+		}
+		minimums = append(minimums, mod)
+	}
+	return mains, minimums, nil
+}
+
+// allowedVersion returns the module, or the next version of it if its version is excluded.
+func (d *Directory) allowedVersion(ctx context.Context, mod *Module) (*Module, error) {
+	if !d.isExcluded(mod.Path, mod.Version) {
+		return mod, nil
+	}
+	next, err := d.nextAllowedVersion(ctx, mod.Path, mod.Version)
+	if err != nil {
+		return nil, fmt.Errorf("%s is excluded: %w", mod.String(), err)
 	}
+	log.Printf("%s is excluded, using %s instead\n", mod.String(), next)
+	return d.SetModule(&Module{Path: mod.Path, Version: next}), nil
 }
 
-// Sync is a lazy implementation to refresh all of the module dependencies to the closest semver.
-func (d *Directory) Sync() {
-	for _, vd := range d.modules {
-		for _, mod := range vd.versions {
-			// Flag this module as requiring to specify the version as we have multiple versions.
-			mod.nameWithVersion = len(vd.versions) > 1
-			for i, dep := range mod.Deps {
-				closestMod := d.GetClosestModule(dep.Path, dep.Version)
-				if dep != closestMod {
-					log.Printf("Synced %s --> %s\n", dep.String(), closestMod.String())
+// loadGraph fetches the requirements of every module version in the requirement graph of the
+// main modules. How far down the graph goes depends on the go versions of the modules in it,
+// which we only know once we have their go.mod files, so it's worked out with what we have
+// so far, and anything it's missing is fetched, until nothing is.
+func (d *Directory) loadGraph(ctx context.Context, mains, minimums []*Module) error {
+	// Work out the replacements up front, as the workers mustn't touch the directory.
+	for _, mod := range append(append([]*Module{}, mains...), minimums...) {
+		err := d.applyReplacement(mod)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		missing := []*Module{}
+		reqs := func(mod *Module) ([]*Module, error) {
+			if mod.requires == nil {
+				missing = append(missing, mod)
+				return nil, nil
+			}
+			required, err := d.requirements(mod)
+			if err != nil {
+				return nil, err
+			}
+			for _, req := range required {
+				err := d.applyReplacement(req)
+				if err != nil {
+					return nil, err
 				}
-				mod.Deps[i] = closestMod
 			}
+			return required, nil
+		}
+		_, err := BuildList(mains, minimums, reqs)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		err = d.fetchAll(ctx, missing, d.loadRequirements, nil)
+		if err != nil {
+			return err
 		}
 	}
 }
 
-func (d *Directory) Print() {
-	// Sort the paths to deterministically print output.
-	paths := make([]string, 0, len(d.modules))
-	for path := range d.modules {
-		paths = append(paths, path)
+// loadRequirements fetches the go.mod of the module, and checks it, for its requirements.
+func (d *Directory) loadRequirements(ctx context.Context, mod *Module) error {
+	err := mod.fetchRequirements(ctx, d.fetcher)
+	if err != nil {
+		return err
 	}
-	sort.Strings(paths)
-	for _, path := range paths {
+	err = d.verify(mod)
+	if err != nil {
+		return err
+	}
+	return d.skipExcluded(ctx, mod)
+}
+
+// without returns the modules other than mod.
+func without(mods []*Module, mod *Module) []*Module {
+	kept := make([]*Module, 0, len(mods))
+	for _, m := range mods {
+		if m != mod {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// requirements returns the modules required by mod, including indirect requirements.
+func (d *Directory) requirements(mod *Module) ([]*Module, error) {
+	if mod.requires == nil {
+		return nil, fmt.Errorf("requirements of module %s have not been loaded yet", mod.String())
+	}
+	required := make([]*Module, 0, len(mod.requires))
+	for _, req := range mod.requires {
+		if d.inRepo(req.Path) {
+			// The repo's own packages are built from source, rather than a third party rule.
+			continue
+		}
+		required = append(required, d.SetModule(&Module{
+			Path:    req.Path,
+			Version: req.Version,
+		}))
+	}
+	return required, nil
+}
+
+// inRepo returns whether the module path is part of the repo itself.
+func (d *Directory) inRepo(path string) bool {
+	return d.ImportPath != "" && (path == d.ImportPath || strings.HasPrefix(path, d.ImportPath+"/"))
+}
+
+// selectVersions marks the modules in the build list as the selected versions, and points
+// the dependencies of each of them at the selected versions.
+func (d *Directory) selectVersions(buildList []*Module) {
+	for _, mod := range buildList {
+		vd := d.Get(mod.Path)
+		vd.selected = mod.Version
+		for _, version := range vd.Versions() {
+			if version != mod.Version {
+				log.Printf("Selected %s over %s\n", mod.String(), version)
+			}
+		}
+		// Keep the name, BUILD file and version of any existing rule for this module, so an
+		// upgrade updates it in place. The install list is worked out again from scratch.
+		if existing := vd.existing(); existing != nil {
+			mod.inherit(existing)
+		}
+	}
+
+	for _, mod := range buildList {
+		mod.Deps = nil
+		for _, req := range mod.requires {
+			if req.Indirect {
+				// Indirect requirements only matter for selecting versions, the module
+				// doesn't actually import them itself.
+				continue
+			}
+			dep := d.GetSelected(req.Path)
+			if dep == nil || dep == mod {
+				continue
+			}
+			mod.Deps = append(mod.Deps, dep)
+		}
+	}
+}
+
+// downloadSelected downloads any of the selected modules we still need that haven't
+// been fully downloaded yet.
+func (d *Directory) downloadSelected(ctx context.Context) error {
+	mods := []*Module{}
+	for _, mod := range d.Modules() {
+		if !mod.downloaded {
+			mods = append(mods, mod)
+		}
+	}
+	download := func(ctx context.Context, mod *Module) error {
+		err := mod.Download(ctx, d.fetcher)
+		if err != nil {
+			return err
+		}
+		return d.verify(mod)
+	}
+	return d.fetchAll(ctx, mods, download, nil)
+}
+
+// targets returns the root modules, along with the modules loaded from existing BUILD files
+// and any upgrades of them.
+func (d *Directory) targets() []*Module {
+	targets := []*Module{}
+	for _, path := range d.paths() {
+		if _, ok := d.removed[path]; ok {
+			continue
+		}
 		vd := d.modules[path]
-		fmt.Printf("MODULE: %s\n", path)
-		// Sort the versions to deterministically print output.
-		versions := make([]string, 0, len(vd.versions))
-		for version := range vd.versions {
-			versions = append(versions, version)
-		}
-		sort.Strings(versions)
-		for _, version := range versions {
+		for _, version := range vd.Versions() {
 			mod := vd.versions[version]
-			fmt.Printf("\tVERSION: %s\n", version)
-			fmt.Printf("\t\t%s\n", mod.String())
-			if len(mod.Deps) > 0 {
-				fmt.Printf("\t\t|\n")
-			}
-			for _, dep := range mod.Deps {
-				fmt.Printf("\t\t|---- %s\n", dep.String())
+			if mod.existingVersion == mod.Version {
+				targets = append(targets, mod)
 			}
 		}
 	}
+	targets = append(targets, d.upgrades...)
+	return append(targets, d.roots...)
 }
 
-func (d *Directory) ExportBuildRules(thirdParty string) error {
-	// Delete all existing third party build files.
-	err := host.RemoveAllThirdPartyFiles()
-	if err != nil {
-		return err
+// selectedRoots returns the selected versions of the roots, which are where we start from
+// when working out which packages are needed.
+func (d *Directory) selectedRoots() []*Module {
+	selected := []*Module{}
+	for _, root := range d.Roots() {
+		if mod := d.GetSelected(root.Path); mod != nil {
+			selected = append(selected, mod)
+		}
 	}
-	// Sort the paths to deterministically write build files.
+	return selected
+}
+
+// selectedTargets returns the selected versions of the targets.
+func (d *Directory) selectedTargets() []*Module {
+	selected := []*Module{}
+	seen := map[*Module]struct{}{}
+	for _, target := range d.targets() {
+		mod := d.GetSelected(target.Path)
+		if mod == nil {
+			continue
+		}
+		if _, ok := seen[mod]; !ok {
+			seen[mod] = struct{}{}
+			selected = append(selected, mod)
+		}
+	}
+	return selected
+}
+
+// Modules returns the selected versions of the modules we need, that is the targets and
+// everything they depend on, sorted by module path.
+func (d *Directory) Modules() []*Module {
+	needed := map[string]*Module{}
+	queue := d.selectedTargets()
+	for len(queue) > 0 {
+		mod := queue[0]
+		queue = queue[1:]
+		if _, ok := needed[mod.Path]; ok {
+			continue
+		}
+		needed[mod.Path] = mod
+		queue = append(queue, mod.Deps...)
+	}
+
+	mods := make([]*Module, 0, len(needed))
+	for _, mod := range needed {
+		mods = append(mods, mod)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].Path < mods[j].Path
+	})
+	return mods
+}
+
+func (d *Directory) Print() {
+	for _, mod := range d.Modules() {
+		fmt.Printf("MODULE: %s\n", mod.Path)
+		fmt.Printf("\tVERSION: %s\n", mod.Version)
+		fmt.Printf("\t\t%s\n", mod.String())
+		if len(mod.Deps) > 0 {
+			fmt.Printf("\t\t|\n")
+		}
+		for _, dep := range mod.Deps {
+			if req, ok := mod.requirement(dep.Path); ok && req.Inferred {
+				fmt.Printf("\t\t|---- %s (inferred)\n", dep.String())
+				continue
+			}
+			fmt.Printf("\t\t|---- %s\n", dep.String())
+		}
+	}
+}
+
+// paths returns the sorted module paths in the directory.
+func (d *Directory) paths() []string {
 	paths := make([]string, 0, len(d.modules))
 	for path := range d.modules {
 		paths = append(paths, path)
 	}
 	sort.Strings(paths)
-	for _, path := range paths {
-		vd := d.modules[path]
-		// Sort the versions to deterministically write build files.
-		versions := make([]string, 0, len(vd.versions))
-		for version := range vd.versions {
-			versions = append(versions, version)
+	return paths
+}
+
+// LoadBuildRules parses the existing BUILD files in the third party directory and adds
+// any go_module or go_repo rules it finds to the directory, so that newly resolved modules are
+// merged in with them rather than replacing them.
+func (d *Directory) LoadBuildRules() error {
+	root := d.thirdParty
+	if root == "" {
+		root = "."
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+
+	loaded := map[string]*Module{}
+	requirements := map[*Module][]string{}
+	err := buildfile.Walk(root, func(path string) error {
+		file, err := buildfile.ParseFile(path)
+		if err != nil {
+			return err
 		}
-		sort.Strings(versions)
-		for _, version := range versions {
-			mod := vd.versions[version]
-			buildFilePath := mod.GetBuildPath(thirdParty)
-			if _, err := os.Stat(buildFilePath); os.IsNotExist(err) { 
-				err = os.MkdirAll(strings.TrimSuffix(buildFilePath, "/BUILD"), 0700) // Create the nested directory
-				if err != nil {
-					return fmt.Errorf("failed to create directory: %w", err)
+		buildDir := filepath.Dir(path)
+		pkg := filepath.ToSlash(buildDir)
+		if pkg == "." {
+			pkg = ""
+		}
+		for _, rule := range file.Rules() {
+			if rule.Name() == "" {
+				continue
+			}
+			modPath := ""
+			if isModuleRule(rule.Kind) {
+				modPath = rule.AttrString("module")
+			}
+			d.addRuleName(pkg, rule.Name(), modPath)
+		}
+		for _, rule := range file.Rules("go_module", "go_repo") {
+			versionRule := rule
+			if download := rule.AttrString("download"); download != "" {
+				versionRule = file.Rule(strings.TrimPrefix(canonicalLabel(download, pkg), "//"+pkg+":"))
+				if versionRule == nil || versionRule.Kind != "go_mod_download" {
+					log.Printf("Skipping %s in %s as we can't find its download rule", rule.Name(), path)
+					continue
 				}
 			}
-			f, err := os.OpenFile(buildFilePath,
-				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to open file: %w", err)
+			mod := &Module{
+				Path:            rule.AttrString("module"),
+				Version:         versionRule.AttrString("version"),
+				Name:            rule.Name(),
+				existingInstall: rule.AttrStrings("install"),
+				buildDir:        buildDir,
+				existingVersion: versionRule.AttrString("version"),
+				fromDisk:        true,
+			}
+			if mod.Path == "" || mod.Version == "" {
+				continue
+			}
+			if downloadPath := versionRule.AttrString("module"); downloadPath != mod.Path {
+				// This module has been replaced with a fork, so keep fetching the fork. The rule
+				// only has the fork's version, so the version of the module it replaced comes
+				// from the lock file, along with the replacement itself.
+				mod.replace = &Module{Path: downloadPath, Version: mod.existingVersion}
+				rep, ok := d.lockedReplacements[mod.Path]
+				if ok && rep.NewPath == downloadPath && rep.NewVersion == mod.existingVersion {
+					if version, ok := d.locked[mod.Path]; ok {
+						mod.Version = version
+					}
+				} else {
+					d.lockedReplacements[mod.Path] = Replacement{OldPath: mod.Path, NewPath: downloadPath, NewVersion: mod.existingVersion}
+				}
 			}
-			defer f.Close()
-			err = mod.WriteGoModuleRule(f)
+			err := d.addSumLabels(versionRule.AttrString("module"), mod.existingVersion, versionRule.AttrStrings("labels"))
 			if err != nil {
-				return fmt.Errorf("failed to append go_module to file: %w", err)
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			for _, dep := range rule.AttrStrings("deps") {
+				mod.existingDeps = append(mod.existingDeps, canonicalLabel(dep, pkg))
 			}
+			if rule.Kind == "go_repo" {
+				requirements[mod] = rule.AttrStrings("requirements")
+			}
+			loaded["//"+pkg+":"+mod.Name] = mod
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load existing build rules: %w", err)
+	}
+
+	// Sort the labels to deterministically load modules.
+	labels := make([]string, 0, len(loaded))
+	for label := range loaded {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		mod := loaded[label]
+		if existing := d.GetModule(mod.Path, mod.Version); existing != nil {
+			log.Printf("Ignoring %s as %s is already defined by %s\n", label, mod.String(), existing.GetFullyQualifiedName())
+			continue
+		}
+		d.SetModule(mod)
+	}
+	// go_repo rules list the module paths they need rather than deps, so work out the labels
+	// of those now that everything has been loaded.
+	for mod, paths := range requirements {
+		for _, path := range paths {
+			if vd := d.Get(path); vd != nil {
+				if dep := vd.existing(); dep != nil {
+					mod.existingDeps = append(mod.existingDeps, dep.GetFullyQualifiedName())
+				}
+			}
+		}
+	}
+	log.Printf("Loaded %d existing modules from %s\n", len(loaded), root)
+	return nil
+}
+
+// ExportBuildRules renders the rules of every selected module into their BUILD files, merging
+// them with whatever is already in there, and deletes the rules of any modules that have been
+// removed or moved elsewhere. Only the files that change are written with the writer, and any
+// left without rules are removed. If anything has been moved, every reference to it in the repo
+// is updated as well.
+func (d *Directory) ExportBuildRules(writer Writer) error {
+	// Group the modules, and the names of the rules to delete, by the build file they belong in.
+	files := map[string][]*Module{}
+	removals := map[string][]string{}
+	for _, mod := range d.Modules() {
+		buildFilePath := mod.GetBuildPath()
+		files[buildFilePath] = append(files[buildFilePath], mod)
+	}
+	for _, mod := range d.removed {
+		buildFilePath := mod.GetBuildPath()
+		removals[buildFilePath] = append(removals[buildFilePath], mod.GetName(), mod.GetDownloadName())
+	}
+	for _, old := range d.moved {
+		removals[old.buildPath] = append(removals[old.buildPath], old.names...)
+	}
+
+	rendered := map[string]*buildfile.File{}
+	for buildFilePath, mods := range files {
+		file, err := renderBuildFile(d.emitter(), buildFilePath, mods, removals[buildFilePath])
+		if err != nil {
+			return err
+		}
+		rendered[buildFilePath] = file
+	}
+	for buildFilePath, names := range removals {
+		if _, ok := files[buildFilePath]; ok {
+			continue
+		}
+		file, err := renderBuildFile(d.emitter(), buildFilePath, nil, names)
+		if err != nil {
+			return err
 		}
+		rendered[buildFilePath] = file
+	}
+	err := d.rewriteLabels(rendered)
+	if err != nil {
+		return err
+	}
+
+	// Sort the paths to deterministically write build files.
+	buildFilePaths := make([]string, 0, len(rendered))
+	for buildFilePath := range rendered {
+		buildFilePaths = append(buildFilePaths, buildFilePath)
+	}
+	sort.Strings(buildFilePaths)
+	for _, buildFilePath := range buildFilePaths {
+		file := rendered[buildFilePath]
+		if old, err := ioutil.ReadFile(buildFilePath); err == nil && bytes.Equal(old, file.Bytes()) {
+			continue
+		}
+		if len(files[buildFilePath]) == 0 && len(file.Rules()) == 0 {
+			err = writer.RemoveFile(buildFilePath)
+		} else {
+			err = writer.WriteFile(buildFilePath, file.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitter returns the emitter for the rules of the modules.
+func (d *Directory) emitter() Emitter {
+	if d.Emitter == nil {
+		return GoModuleEmitter{}
+	}
+	return d.Emitter
+}
+
+// renderBuildFile merges the rules the emitter produces for the modules into the BUILD file at
+// buildFilePath, replacing any existing rules for them, and deletes the module rules with the
+// removed names, leaving everything else untouched.
+func renderBuildFile(emitter Emitter, buildFilePath string, mods []*Module, removed []string) (*buildfile.File, error) {
+	file := &buildfile.File{Path: buildFilePath}
+	if _, err := os.Stat(buildFilePath); err == nil {
+		file, err = buildfile.ParseFile(buildFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range removed {
+		if r := file.Rule(name); r != nil && isModuleRule(r.Kind) {
+			file.Remove(r)
+		}
+	}
+
+	for _, mod := range mods {
+		err := mergeRule(file, mod, string(formatRules(emitter.Rules(mod))))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// mergeRule replaces the existing rules for the module in the file with the new rule,
+// or appends it if it doesn't exist yet.
+func mergeRule(file *buildfile.File, mod *Module, rule string) error {
+	existing := []*buildfile.Rule{}
+	for _, name := range []string{mod.GetName(), mod.GetDownloadName()} {
+		r := file.Rule(name)
+		if r == nil {
+			continue
+		}
+		if !isModuleRule(r.Kind) || (r.AttrString("module") != mod.Path && r.AttrString("module") != mod.GetDownloadPath()) {
+			return fmt.Errorf("%s already has a %s rule named %q, can't add %s", file.Path, r.Kind, name, mod.String())
+		}
+		existing = append(existing, r)
+	}
+	if len(existing) == 0 {
+		file.Append(rule)
+		return nil
+	}
+	file.Replace(existing[0], rule)
+	for _, r := range existing[1:] {
+		file.Remove(r)
 	}
 	return nil
 }
 
+// canonicalLabel returns the fully qualified form of a build label relative to pkg.
+func canonicalLabel(label, pkg string) string {
+	if strings.HasPrefix(label, ":") {
+		return "//" + pkg + label
+	}
+	if strings.HasPrefix(label, "//") && !strings.Contains(label, ":") {
+		return label + ":" + path.Base(label)
+	}
+	return label
+}
+
 func (d *Directory) Get(path string) *VersionDirectory {
 	vd, ok := d.modules[path]
 	if !ok {
@@ -135,43 +779,52 @@ func (d *Directory) GetModule(path, version string) *Module {
 	if vd == nil {
 		return nil
 	}
-	mod := vd.GetVersion(version)
-	if mod == nil {
-		return nil
-	}
-	return mod
+	return vd.GetVersion(version)
 }
 
-func (d *Directory) GetClosestModule(path, version string) *Module {
+// GetSelected returns the version of the module selected by Resolve, or nil if the module
+// is not in the build list.
+func (d *Directory) GetSelected(path string) *Module {
 	vd := d.Get(path)
 	if vd == nil {
 		return nil
 	}
-	closestVersion := vd.GetClosestVersion(version)
-	mod := vd.GetVersion(closestVersion)
-	if mod == nil {
-		return nil
-	}
-	return mod
+	return vd.Selected()
 }
 
+// SetModule adds the module to the directory, returning the existing module if this
+// version has already been added.
 func (d *Directory) SetModule(mod *Module) *Module {
 	vd := d.Get(mod.Path)
 	if vd == nil {
 		vd = NewVersionDirectory()
+		d.Set(mod.Path, vd)
 	}
-
-	fixedMod := vd.SetVersion(mod.Version, mod)
-	d.Set(mod.Path, vd)
-	return fixedMod
+	if existing := vd.GetVersion(mod.Version); existing != nil {
+		return existing
+	}
+	if mod.thirdParty == "" {
+		mod.thirdParty = d.thirdParty
+	}
+	if mod.layout == "" {
+		mod.layout = d.Layout
+	}
+	if config, ok := d.config[mod.Path]; ok {
+		mod.applyConfig(config)
+	}
+	vd.versions[mod.Version] = mod
+	return mod
 }
 
 func (d *Directory) Set(path string, vd *VersionDirectory) {
 	d.modules[path] = vd
 }
 
+// VersionDirectory stores every version of a module we have come across in the
+// requirement graph, along with the version that was selected.
 type VersionDirectory struct {
 	versions map[string]*Module
+	selected string
 }
 
 func NewVersionDirectory() *VersionDirectory {
@@ -188,58 +841,40 @@ func (vd *VersionDirectory) GetVersion(version string) *Module {
 	return mod
 }
 
-// GetClosestVersion returns the highest semver within the same major version,
-// or itself if no matches found.
-func (vd *VersionDirectory) GetClosestVersion(version string) string {
-	major := semver.Major(version)
-	for existingVers := range vd.versions {
-		existingMajor := semver.Major(existingVers)
-		if major == existingMajor {
-			comparison := semver.Compare(version, existingVers)
-			// If incoming is less than existing, return existing.
-			if comparison < 0 {
-				return existingVers
-			}
-		}
-	}
-	return version
+// Selected returns the selected version of the module, or nil if one hasn't been selected.
+func (vd *VersionDirectory) Selected() *Module {
+	return vd.GetVersion(vd.selected)
 }
 
-func (vd *VersionDirectory) SetVersion(version string, mod *Module) *Module {
-	// If this version already exists, overwrite with the new one and return.
-	if existing := vd.GetVersion(version); existing != nil {
-		vd.versions[version] = mod
-		return mod
+// Versions returns all of the known versions of the module, in semver order.
+func (vd *VersionDirectory) Versions() []string {
+	versions := make([]string, 0, len(vd.versions))
+	for version := range vd.versions {
+		versions = append(versions, version)
 	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return versions
+}
 
-	// Get existing versions.
-	// If there is an existing version with the same major, but higher minor,
-	// then return the existing version as it is "better".
-	// If there is an existing version with the same major, but lower minor,
-	// then delete that version, and store this "better" version and return.
-	// If there is an existing version with different major, or none at all,
-	// then store this "different" version and return.
-	// 
-	// This should eventually lead to there only being one entry
-	// for each major version.
-	// A different implementation may choose to have stricter/more relaxed
-	// version resolving logic.
-	major := semver.Major(version)
-	for existingVers, existingMod := range vd.versions {
-		existingMajor := semver.Major(existingVers)
-		if major == existingMajor {
-			comparison := semver.Compare(version, existingVers)
-			// If incoming is greater than existing, replace and return.
-			if comparison > 0 {
-				delete(vd.versions, existingVers)
-				vd.versions[version] = mod
-				return mod
-			}
-			// If incoming is less than existing, return existing.
-			return existingMod
+// existing returns the module loaded from the rules already on disk, if any.
+func (vd *VersionDirectory) existing() *Module {
+	for _, mod := range vd.versions {
+		if mod.fromDisk {
+			return mod
 		}
 	}
+	return nil
+}
 
-	vd.versions[version] = mod
-	return mod
+// existingVersion returns the version of the module already written to disk, if any. This is
+// the version that gets downloaded, which is the fork's version for replaced modules.
+func (vd *VersionDirectory) existingVersion() string {
+	for _, mod := range vd.versions {
+		if mod.existingVersion != "" {
+			return mod.existingVersion
+		}
+	}
+	return ""
 }
@@ -0,0 +1,114 @@
+package module
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultJobs is the default number of modules fetched at once.
+const DefaultJobs = 8
+
+// fetchResult is what a worker sends back once it has fetched a module.
+type fetchResult struct {
+	mod *Module
+	err error
+}
+
+// fetchAll runs fetch for each of the modules on a pool of workers, and then calls next
+// with each fetched module to find any more modules to fetch. Each module version is only
+// fetched once, no matter how many times it comes up.
+//
+// The queue of modules waiting to be fetched is only ever touched by the calling goroutine,
+// which hands modules out to the workers and collects their results. It never blocks on a
+// worker that is blocked on it, so adding more work can't deadlock like it could with a
+// fixed size channel. next is also called from the calling goroutine, so it is free to
+// modify the directory without any locking. fetch must only touch the module it is given.
+//
+// The first error cancels the context passed to the remaining fetches, and is returned once
+// all of the workers have stopped.
+func (d *Directory) fetchAll(ctx context.Context, mods []*Module, fetch func(context.Context, *Module) error, next func(*Module) ([]*Module, error)) error {
+	jobs := d.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan *Module)
+	results := make(chan fetchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mod := range work {
+				results <- fetchResult{mod: mod, err: fetch(ctx, mod)}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	// The directory only holds one module per path@version, so we can dedup on the
+	// pointer, which also means we never read a module while a worker is writing to it.
+	seen := map[*Module]struct{}{}
+	queue := []*Module{}
+	enqueue := func(mods []*Module) {
+		for _, mod := range mods {
+			if _, ok := seen[mod]; ok {
+				continue
+			}
+			seen[mod] = struct{}{}
+			queue = append(queue, mod)
+		}
+	}
+	enqueue(mods)
+
+	inFlight := 0
+	for inFlight > 0 || (len(queue) > 0 && firstErr == nil) {
+		// Only offer work to the workers if we have some, and haven't failed yet. A nil
+		// channel blocks forever, so the select just waits for results otherwise.
+		var send chan *Module
+		var mod *Module
+		if len(queue) > 0 && firstErr == nil {
+			send, mod = work, queue[0]
+		}
+		var done <-chan struct{}
+		if firstErr == nil {
+			done = ctx.Done()
+		}
+
+		select {
+		case send <- mod:
+			queue = queue[1:]
+			inFlight++
+		case result := <-results:
+			inFlight--
+			if result.err != nil {
+				fail(result.err)
+				continue
+			}
+			if firstErr != nil || next == nil {
+				continue
+			}
+			more, err := next(result.mod)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			enqueue(more)
+		case <-done:
+			fail(ctx.Err())
+		}
+	}
+	return firstErr
+}
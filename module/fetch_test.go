@@ -0,0 +1,254 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamesjarvis/go-deps/host"
+)
+
+// fakeFetcher pretends to download modules, taking a little while over each one so that
+// the workers overlap, and counts how many times each module version is fetched.
+type fakeFetcher struct {
+	// fail is the error to fail fetching each module path with.
+	fail map[string]error
+	// hang is the module paths that never finish fetching, until they're cancelled.
+	hang map[string]bool
+	// versions are the versions List returns for each module path.
+	versions map[string][]string
+
+	mu        sync.Mutex
+	fetches   map[string]int
+	cancelled int
+}
+
+func newFakeFetcher() *fakeFetcher {
+	return &fakeFetcher{
+		fail:     map[string]error{},
+		hang:     map[string]bool{},
+		versions: map[string][]string{},
+		fetches:  map[string]int{},
+	}
+}
+
+// delay returns how long fetching the module takes, which is up to a few milliseconds and
+// the same every time for the same module.
+func delay(path string) time.Duration {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return time.Duration(h.Sum32()%4) * time.Millisecond
+}
+
+func (f *fakeFetcher) DownloadGoMod(ctx context.Context, path, query string) (*host.GoModDownloadResponse, error) {
+	f.mu.Lock()
+	f.fetches[path+"@"+query]++
+	f.mu.Unlock()
+
+	wait := delay(path)
+	if f.hang[path] {
+		wait = time.Hour
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+		f.mu.Lock()
+		f.cancelled++
+		f.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	if err := f.fail[path]; err != nil {
+		return nil, err
+	}
+	return &host.GoModDownloadResponse{Path: path, Version: query}, nil
+}
+
+func (f *fakeFetcher) Download(ctx context.Context, path, query string) (*host.GoModDownloadResponse, error) {
+	return f.DownloadGoMod(ctx, path, query)
+}
+
+func (f *fakeFetcher) List(ctx context.Context, path string) ([]string, error) {
+	if err := f.fail[path]; err != nil {
+		return nil, err
+	}
+	return f.versions[path], nil
+}
+
+// fetchGraph runs fetchAll from the root of the graph with the fetcher, using the graph to
+// find the modules each module requires.
+func fetchGraph(ctx context.Context, jobs int, fetcher *fakeFetcher, g graph, root string) error {
+	d := NewDirectory("third_party/go", fetcher)
+	d.Jobs = jobs
+	fetch := func(ctx context.Context, mod *Module) error {
+		_, err := fetcher.DownloadGoMod(ctx, mod.Path, mod.Version)
+		return err
+	}
+	next := func(mod *Module) ([]*Module, error) {
+		required, err := g.reqs(mod)
+		if err != nil {
+			return nil, err
+		}
+		for i, req := range required {
+			required[i] = d.SetModule(req)
+		}
+		return required, nil
+	}
+	return d.fetchAll(ctx, []*Module{d.SetModule(parseModule(root))}, fetch, next)
+}
+
+// sharedGraph returns a graph where the root requires n modules, which all require the
+// same n shared modules.
+func sharedGraph(n int) graph {
+	g := graph{}
+	shared := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		shared = append(shared, fmt.Sprintf("shared%d@v1.0.0", i))
+	}
+	for i := 0; i < n; i++ {
+		mod := fmt.Sprintf("mod%d@v1.0.0", i)
+		g["root@v1.0.0"] = append(g["root@v1.0.0"], mod)
+		g[mod] = shared
+	}
+	return g
+}
+
+// withTimeout fails the test if fn doesn't return in time, rather than waiting for the
+// whole test binary to time out on a deadlock.
+func withTimeout(t *testing.T, fn func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetchAll didn't return, it looks deadlocked")
+		return nil
+	}
+}
+
+func TestFetchAllFetchesEachModuleOnce(t *testing.T) {
+	for _, jobs := range []int{1, 4, DefaultJobs} {
+		t.Run(fmt.Sprintf("%d jobs", jobs), func(t *testing.T) {
+			fetcher := newFakeFetcher()
+			err := withTimeout(t, func() error {
+				return fetchGraph(context.Background(), jobs, fetcher, sharedGraph(20), "root@v1.0.0")
+			})
+			if err != nil {
+				t.Fatalf("fetchAll() failed: %v", err)
+			}
+			// The root, 20 modules and 20 shared modules.
+			if len(fetcher.fetches) != 41 {
+				t.Errorf("fetched %d modules, want 41", len(fetcher.fetches))
+			}
+			for mod, n := range fetcher.fetches {
+				if n != 1 {
+					t.Errorf("fetched %s %d times, want once", mod, n)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchAllStopsAtTheFirstError(t *testing.T) {
+	errBroken := errors.New("broken")
+	fetcher := newFakeFetcher()
+	fetcher.fail["broken"] = errBroken
+	g := graph{"root@v1.0.0": {"broken@v1.0.0"}}
+	for i := 0; i < 10; i++ {
+		mod := fmt.Sprintf("hang%d", i)
+		fetcher.hang[mod] = true
+		g["root@v1.0.0"] = append(g["root@v1.0.0"], mod+"@v1.0.0")
+	}
+
+	err := withTimeout(t, func() error {
+		return fetchGraph(context.Background(), 4, fetcher, g, "root@v1.0.0")
+	})
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("fetchAll() error = %v, want %v", err, errBroken)
+	}
+	// Nothing else can finish, so everything that was started must have been cancelled, and
+	// nothing new started after the error.
+	started := len(fetcher.fetches) - 2
+	if fetcher.cancelled != started {
+		t.Errorf("%d fetches were cancelled, want all %d that were started", fetcher.cancelled, started)
+	}
+	if started >= 10 {
+		t.Errorf("started all of the fetches, want them to stop after the error")
+	}
+}
+
+func TestFetchAllStopsWhenNextFails(t *testing.T) {
+	errNext := errors.New("bad go.mod")
+	fetcher := newFakeFetcher()
+	d := NewDirectory("third_party/go", fetcher)
+	fetch := func(ctx context.Context, mod *Module) error {
+		_, err := fetcher.DownloadGoMod(ctx, mod.Path, mod.Version)
+		return err
+	}
+	g := sharedGraph(20)
+	next := func(mod *Module) ([]*Module, error) {
+		if mod.Path == "b" {
+			return nil, errNext
+		}
+		required, err := g.reqs(mod)
+		for i, req := range required {
+			required[i] = d.SetModule(req)
+		}
+		return required, err
+	}
+	mods := []*Module{d.SetModule(parseModule("root@v1.0.0")), d.SetModule(parseModule("b@v1.0.0"))}
+	err := withTimeout(t, func() error {
+		return d.fetchAll(context.Background(), mods, fetch, next)
+	})
+	if !errors.Is(err, errNext) {
+		t.Errorf("fetchAll() error = %v, want %v", err, errNext)
+	}
+}
+
+func TestFetchAllFansOutWithoutDeadlocking(t *testing.T) {
+	// Every module requires lots of new ones, so there is always far more work queued up
+	// than there are workers to take it.
+	g := graph{}
+	for i := 0; i < 10; i++ {
+		parent := fmt.Sprintf("m%d@v1.0.0", i)
+		if i == 0 {
+			parent = "root@v1.0.0"
+		}
+		for j := 0; j < 50; j++ {
+			g[parent] = append(g[parent], fmt.Sprintf("m%d/%d@v1.0.0", i+1, j))
+		}
+		g[parent] = append(g[parent], fmt.Sprintf("m%d@v1.0.0", i+1))
+	}
+	for _, jobs := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%d jobs", jobs), func(t *testing.T) {
+			fetcher := newFakeFetcher()
+			err := withTimeout(t, func() error {
+				return fetchGraph(context.Background(), jobs, fetcher, g, "root@v1.0.0")
+			})
+			if err != nil {
+				t.Fatalf("fetchAll() failed: %v", err)
+			}
+			if len(fetcher.fetches) != 511 {
+				t.Errorf("fetched %d modules, want 511", len(fetcher.fetches))
+			}
+		})
+	}
+}
+
+func TestFetchAllCancelled(t *testing.T) {
+	fetcher := newFakeFetcher()
+	fetcher.hang["root"] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := withTimeout(t, func() error {
+		return fetchGraph(ctx, 2, fetcher, graph{}, "root@v1.0.0")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("fetchAll() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,168 @@
+package module
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The formats the module graph can be exported in.
+const (
+	FormatDOT     = "dot"
+	FormatJSON    = "json"
+	FormatMermaid = "mermaid"
+)
+
+// Graph is the resolved module graph, as exported by Export.
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// GraphNode is a selected module.
+type GraphNode struct {
+	Path    string
+	Version string
+	Sum     string
+	// Target is the build label of the module's rule, and Package is the package of the
+	// BUILD file that it's in.
+	Target  string
+	Package string
+}
+
+// GraphEdge is a dependency of one module on another.
+type GraphEdge struct {
+	From string
+	To   string
+	// Requested is the version From requires, and Selected is the version that was picked.
+	Requested string
+	Selected  string
+	// Inferred is set if From doesn't have a go.mod file, and the dependency was inferred from
+	// its imports.
+	Inferred bool `json:",omitempty"`
+}
+
+// Graph returns the graph of the modules we need, with the nodes sorted by path.
+func (d *Directory) Graph() *Graph {
+	graph := &Graph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	for _, mod := range d.Modules() {
+		target := mod.GetFullyQualifiedName()
+		graph.Nodes = append(graph.Nodes, GraphNode{
+			Path:    mod.Path,
+			Version: mod.Version,
+			Sum:     mod.Sum,
+			Target:  target,
+			Package: target[:strings.LastIndex(target, ":")],
+		})
+		for _, dep := range mod.Deps {
+			edge := GraphEdge{
+				From:      mod.Path,
+				To:        dep.Path,
+				Requested: dep.Version,
+				Selected:  dep.Version,
+			}
+			if req, ok := mod.requirement(dep.Path); ok {
+				edge.Requested = req.Version
+				edge.Inferred = req.Inferred
+			}
+			graph.Edges = append(graph.Edges, edge)
+		}
+	}
+	return graph
+}
+
+// Export writes the graph of the modules we need in the given format, which is one of
+// FormatDOT, FormatJSON or FormatMermaid. In DOT and Mermaid, the modules are clustered by
+// the BUILD file their rules are in.
+func (d *Directory) Export(w io.Writer, format string) error {
+	graph := d.Graph()
+	switch format {
+	case FormatDOT:
+		return graph.writeDOT(w)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(graph)
+	case FormatMermaid:
+		return graph.writeMermaid(w)
+	}
+	return fmt.Errorf("unknown graph format %q, expected one of %s, %s or %s", format, FormatDOT, FormatJSON, FormatMermaid)
+}
+
+// packages returns the nodes grouped by package, with the packages in sorted order.
+func (g *Graph) packages() ([]string, map[string][]GraphNode) {
+	nodes := map[string][]GraphNode{}
+	for _, node := range g.Nodes {
+		nodes[node.Package] = append(nodes[node.Package], node)
+	}
+	pkgs := make([]string, 0, len(nodes))
+	for pkg := range nodes {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	return pkgs, nodes
+}
+
+// label returns the label of the edge, which shows the version that was actually selected
+// if it's different to the one that was asked for, and whether the dependency was inferred.
+func (e GraphEdge) label() string {
+	label := e.Requested
+	if e.Requested != e.Selected {
+		label = fmt.Sprintf("%s (selected %s)", e.Requested, e.Selected)
+	}
+	if e.Inferred {
+		label += " (inferred)"
+	}
+	return label
+}
+
+func (g *Graph) writeDOT(w io.Writer) error {
+	var out strings.Builder
+	out.WriteString("digraph modules {\n")
+	out.WriteString("  rankdir = LR;\n")
+	out.WriteString("  node [shape = box];\n")
+	pkgs, nodes := g.packages()
+	for i, pkg := range pkgs {
+		fmt.Fprintf(&out, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&out, "    label = %q;\n", pkg)
+		for _, node := range nodes[pkg] {
+			fmt.Fprintf(&out, "    %q [label = %q];\n", node.Path, node.Path+"\n"+node.Version)
+		}
+		out.WriteString("  }\n")
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&out, "  %q -> %q [label = %q];\n", edge.From, edge.To, edge.label())
+	}
+	out.WriteString("}\n")
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func (g *Graph) writeMermaid(w io.Writer) error {
+	// Mermaid ids can't contain most of the characters in module paths, so number them.
+	ids := map[string]string{}
+	for i, node := range g.Nodes {
+		ids[node.Path] = fmt.Sprintf("m%d", i)
+	}
+
+	var out strings.Builder
+	out.WriteString("graph LR\n")
+	pkgs, nodes := g.packages()
+	for i, pkg := range pkgs {
+		fmt.Fprintf(&out, "  subgraph p%d [\"%s\"]\n", i, pkg)
+		for _, node := range nodes[pkg] {
+			fmt.Fprintf(&out, "    %s[\"%s@%s\"]\n", ids[node.Path], node.Path, node.Version)
+		}
+		out.WriteString("  end\n")
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&out, "  %s -->|\"%s\"| %s\n", ids[edge.From], edge.label(), ids[edge.To])
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
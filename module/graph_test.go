@@ -0,0 +1,85 @@
+package module
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: FormatDOT,
+			want: `digraph modules {
+  rankdir = LR;
+  node [shape = box];
+  subgraph cluster_0 {
+    label = "//third_party/go";
+    "a" [label = "a\nv1.0.0"];
+    "b" [label = "b\nv1.1.0"];
+    "c" [label = "c\nv1.0.0"];
+  }
+  "a" -> "b" [label = "v1.0.0 (selected v1.1.0)"];
+  "a" -> "c" [label = "v1.0.0"];
+  "c" -> "b" [label = "v1.1.0"];
+}
+`,
+		},
+		{
+			format: FormatMermaid,
+			want: `graph LR
+  subgraph p0 ["//third_party/go"]
+    m0["a@v1.0.0"]
+    m1["b@v1.1.0"]
+    m2["c@v1.0.0"]
+  end
+  m0 -->|"v1.0.0 (selected v1.1.0)"| m1
+  m0 -->|"v1.0.0"| m2
+  m2 -->|"v1.1.0"| m1
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			d := resolveGraph(t, whyGraph, "a@v1.0.0")
+			var out strings.Builder
+			if err := d.Export(&out, test.format); err != nil {
+				t.Fatalf("Export() failed: %v", err)
+			}
+			if out.String() != test.want {
+				t.Errorf("Export() =\n%s\nwant\n%s", out.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	d := resolveGraph(t, whyGraph, "a@v1.0.0")
+	var out strings.Builder
+	if err := d.Export(&out, FormatJSON); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	graph := &Graph{}
+	if err := json.Unmarshal([]byte(out.String()), graph); err != nil {
+		t.Fatalf("Export() wrote invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(graph, d.Graph()) {
+		t.Errorf("Export() = %+v, want %+v", graph, d.Graph())
+	}
+}
+
+func TestExportUnknownFormat(t *testing.T) {
+	d := resolveGraph(t, whyGraph, "a@v1.0.0")
+	var out strings.Builder
+	err := d.Export(&out, "svg")
+	if err == nil || !strings.Contains(err.Error(), `unknown graph format "svg"`) {
+		t.Errorf("Export() error = %v, want the format to be unknown", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Export() wrote %q, want nothing", out.String())
+	}
+}
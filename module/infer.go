@@ -0,0 +1,162 @@
+package module
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+)
+
+// inferRequirements works out the requirements of the selected modules that don't have a
+// go.mod file, by mapping the imports of the packages we need from them to the modules that
+// provide them. These are added to the module's requirements marked as inferred, and it
+// returns whether any new requirements were found.
+func (d *Directory) inferRequirements(ctx context.Context) (bool, error) {
+	in, err := newInstaller(d.Modules(), d.Platform)
+	if err != nil {
+		return false, err
+	}
+	for _, mod := range d.selectedRoots() {
+		for _, rel := range in.candidates(mod) {
+			in.use(mod, rel)
+		}
+	}
+
+	changed := false
+	for _, mod := range in.mods {
+		if !mod.downloaded || mod.hasGoMod() {
+			continue
+		}
+		for _, imp := range in.externalImports(mod) {
+			if d.inRepo(imp) {
+				continue
+			}
+			owner := d.selectedOwner(imp)
+			if owner == nil {
+				if _, ok := d.unresolvable[imp]; ok {
+					continue
+				}
+				owner = d.lockedOwner(imp)
+			}
+			if owner == nil {
+				owner, err = findModuleProviding(ctx, d.fetcher, imp)
+				if err != nil {
+					log.Printf("Unable to find the module providing %s, imported by %s: %s\n", imp, mod.String(), err)
+					d.unresolvable[imp] = struct{}{}
+					continue
+				}
+			}
+			if owner.Path == mod.Path {
+				continue
+			}
+			if _, ok := mod.requirement(owner.Path); ok {
+				continue
+			}
+			log.Printf("Inferred %s --> %s from its imports\n", mod.String(), owner.String())
+			mod.requires = append(mod.requires, Requirement{Path: owner.Path, Version: owner.Version, Inferred: true})
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// inferInstalledDeps adds the dependencies of the packages we install from modules without a
+// go.mod file that weren't picked up by inferRequirements. These are packages we didn't need
+// ourselves, but install anyway as everything they import is available, so they only ever
+// depend on modules we have already selected.
+func (d *Directory) inferInstalledDeps() error {
+	in, err := newInstaller(d.Modules(), d.Platform)
+	if err != nil {
+		return err
+	}
+	for _, mod := range in.mods {
+		if !mod.downloaded || mod.hasGoMod() {
+			continue
+		}
+		in.used[mod] = map[string]struct{}{}
+		for rel := range in.pkgs[mod] {
+			if matchesInstall(mod.GetInstall(), rel) {
+				in.used[mod][rel] = struct{}{}
+			}
+		}
+		for _, imp := range in.externalImports(mod) {
+			if d.inRepo(imp) {
+				continue
+			}
+			owner := d.selectedOwner(imp)
+			if owner == nil || owner.Path == mod.Path {
+				continue
+			}
+			if _, ok := mod.requirement(owner.Path); ok {
+				continue
+			}
+			log.Printf("Inferred %s --> %s from its imports\n", mod.String(), owner.String())
+			mod.requires = append(mod.requires, Requirement{Path: owner.Path, Version: owner.Version, Inferred: true})
+			mod.Deps = append(mod.Deps, owner)
+		}
+	}
+	return nil
+}
+
+// selectedOwner returns the selected module with the longest path providing the import path.
+func (d *Directory) selectedOwner(importPath string) *Module {
+	var owner *Module
+	for path, vd := range d.modules {
+		if importPath != path && !strings.HasPrefix(importPath, path+"/") {
+			continue
+		}
+		if selected := vd.Selected(); selected != nil && (owner == nil || len(path) > len(owner.Path)) {
+			owner = selected
+		}
+	}
+	return owner
+}
+
+// externalImports returns the sorted, non standard library imports of the packages we use
+// from the module that come from other modules.
+func (in *installer) externalImports(mod *Module) []string {
+	seen := map[string]struct{}{}
+	for rel := range in.used[mod] {
+		for _, imp := range in.pkgs[mod][rel].Imports {
+			if isStdLib(imp) || imp == mod.Path || strings.HasPrefix(imp, mod.Path+"/") {
+				continue
+			}
+			seen[imp] = struct{}{}
+		}
+	}
+	imports := make([]string, 0, len(seen))
+	for imp := range seen {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// findModuleProviding looks up the latest version of the module providing the import path,
+// trying each parent of the import path in turn, in the same way `go get` does.
+func findModuleProviding(ctx context.Context, fetcher Fetcher, importPath string) (*Module, error) {
+	splitPath := strings.Split(importPath, "/")
+	var err error
+	for i := len(splitPath); i >= 2; i-- {
+		mod := &Module{
+			Path:    strings.Join(splitPath[:i], "/"),
+			Version: "latest",
+		}
+		err = mod.DownloadGoMod(ctx, fetcher)
+		if err == nil {
+			return mod, nil
+		}
+	}
+	return nil, err
+}
+
+// inferred returns the paths of the modules that the module's inferred requirements are on.
+func (m *Module) inferred() []string {
+	var paths []string
+	for _, req := range m.requires {
+		if req.Inferred {
+			paths = append(paths, req.Path)
+		}
+	}
+	return dedupe(paths)
+}
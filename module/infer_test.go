@@ -0,0 +1,77 @@
+package module
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// inferredDirectory returns a resolved third party directory where old doesn't have a go.mod,
+// so its requirement on dep was inferred, and new requires dep in its go.mod.
+func inferredDirectory(thirdParty string) *Directory {
+	d := NewDirectory(thirdParty, nil)
+	old := d.SetModule(parseModule("example.com/old@v1.0.0"))
+	old.requires = []Requirement{{Path: "example.com/dep", Version: "v1.0.0", Inferred: true}}
+	newer := d.SetModule(parseModule("example.com/new@v1.0.0"))
+	newer.requires = []Requirement{{Path: "example.com/dep", Version: "v1.1.0"}}
+	dep := d.SetModule(parseModule("example.com/dep@v1.1.0"))
+	d.roots = append(d.roots, old, newer)
+	d.selectVersions([]*Module{dep, newer, old})
+	d.resolved = true
+	return d
+}
+
+func TestLockRecordsInferredRequirements(t *testing.T) {
+	dir := t.TempDir()
+	d := inferredDirectory(dir)
+	inferred := map[string][]string{}
+	for _, mod := range d.Lock().Modules {
+		inferred[mod.Path] = mod.Inferred
+	}
+	want := map[string][]string{
+		"example.com/dep": nil,
+		"example.com/new": nil,
+		"example.com/old": {"example.com/dep"},
+	}
+	if !reflect.DeepEqual(inferred, want) {
+		t.Fatalf("locked inferred requirements = %v, want %v", inferred, want)
+	}
+
+	// A directory that hasn't been resolved keeps what the lock file says.
+	if err := d.WriteLock(FileWriter{}); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDirectory(dir, nil)
+	if err := loaded.LoadLock(filepath.Join(dir, LockFileName), false); err != nil {
+		t.Fatalf("LoadLock() failed: %v", err)
+	}
+	if got := loaded.lockedInferred["example.com/old"]; !reflect.DeepEqual(got, []string{"example.com/dep"}) {
+		t.Errorf("loaded inferred requirements of old = %v, want [example.com/dep]", got)
+	}
+}
+
+func TestGraphMarksInferredEdges(t *testing.T) {
+	d := inferredDirectory("third_party/go")
+	for _, edge := range d.Graph().Edges {
+		if want := edge.From == "example.com/old"; edge.Inferred != want {
+			t.Errorf("edge %s -> %s inferred = %v, want %v", edge.From, edge.To, edge.Inferred, want)
+		}
+	}
+
+	var out strings.Builder
+	if err := d.Export(&out, FormatDOT); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	if want := `"example.com/old" -> "example.com/dep" [label = "v1.0.0 (selected v1.1.0) (inferred)"];`; !strings.Contains(out.String(), want) {
+		t.Errorf("Export() = %s\nwant it to contain %s", out.String(), want)
+	}
+
+	explanation, err := d.Why("example.com/dep")
+	if err != nil {
+		t.Fatalf("Why() failed: %v", err)
+	}
+	if got := explanation.Requirements[0].RequiredBy; !reflect.DeepEqual(got, []string{"example.com/old@v1.0.0 (inferred)"}) {
+		t.Errorf("Why() v1.0.0 required by %v, want it marked as inferred", got)
+	}
+}
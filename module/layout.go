@@ -0,0 +1,179 @@
+package module
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesjarvis/go-deps/buildfile"
+	"golang.org/x/mod/module"
+)
+
+// Layout decides which BUILD file in the third party directory each module's rule goes in.
+type Layout string
+
+const (
+	// LayoutSingle puts every rule in the BUILD file at the root of the third party directory.
+	LayoutSingle Layout = "single"
+	// LayoutPerHost has a BUILD file for each host, e.g. third_party/go/github.com.
+	LayoutPerHost Layout = "per-host"
+	// LayoutPerOrg has a BUILD file for each org, e.g. third_party/go/github.com/stretchr, or
+	// for the host if the module path is too short to have an org. This is the default.
+	LayoutPerOrg Layout = "per-org"
+	// LayoutPerModule has a BUILD file for each module.
+	LayoutPerModule Layout = "per-module"
+)
+
+// ParseLayout returns the layout with the given name.
+func ParseLayout(name string) (Layout, error) {
+	switch layout := Layout(name); layout {
+	case LayoutSingle, LayoutPerHost, LayoutPerOrg, LayoutPerModule:
+		return layout, nil
+	}
+	return "", fmt.Errorf("unknown layout %q, expected one of %s, %s, %s or %s", name, LayoutSingle, LayoutPerHost, LayoutPerOrg, LayoutPerModule)
+}
+
+// target returns the package, relative to the third party directory, and the name of the rule
+// for the module at modPath. The name is whatever is left of the path once the package has been
+// taken off, apart from the single and per module layouts, which just use the last part of it.
+// Major version suffixes are moved into the name, so that every major version of a module ends
+// up next to each other, e.g. github.com/a/b/v2 is github.com/a:b_v2 in the per org layout, and
+// gopkg.in/yaml.v2 is gopkg.in:yaml.v2.
+func (l Layout) target(modPath string) (string, string) {
+	prefix, major, ok := module.SplitPathVersion(modPath)
+	if !ok {
+		prefix, major = modPath, ""
+	}
+	parts := strings.Split(prefix, "/")
+	last := parts[len(parts)-1]
+
+	var pkg, name string
+	switch l {
+	case LayoutSingle:
+		name = last
+	case LayoutPerModule:
+		pkg, name = prefix, last
+	default:
+		depth := 2
+		if l == LayoutPerHost {
+			depth = 1
+		}
+		if depth > len(parts)-1 {
+			depth = len(parts) - 1
+		}
+		pkg, name = path.Join(parts[:depth]...), strings.Join(parts[depth:], "_")
+	}
+
+	switch {
+	case strings.HasPrefix(major, "/"):
+		name += "_" + major[1:]
+	case strings.HasPrefix(major, "."):
+		// gopkg.in style, which everyone already knows as yaml.v2 and so on.
+		name += major
+	}
+	return pkg, name
+}
+
+// movedRule is where the rules of a module were before it was moved.
+type movedRule struct {
+	buildPath string
+	label     string
+	names     []string
+}
+
+// Move moves the rules already on disk that aren't where the directory's layout would put them,
+// returning the modules that will be moved, sorted by path. They are given new names in their
+// new BUILD files once they have been resolved, and every reference to them in the repo is
+// updated when the rules are written.
+func (d *Directory) Move() []*Module {
+	moved := []*Module{}
+	for _, modPath := range d.paths() {
+		if _, ok := d.removed[modPath]; ok {
+			continue
+		}
+		vd := d.modules[modPath]
+		existing := vd.existing()
+		if existing == nil {
+			continue
+		}
+		pkg, _ := d.Layout.target(modPath)
+		if path.Join(filepath.ToSlash(d.thirdParty), pkg) == existing.buildPackage() {
+			continue
+		}
+		d.moved[modPath] = movedRule{
+			buildPath: existing.GetBuildPath(),
+			label:     existing.GetFullyQualifiedName(),
+			names:     []string{existing.GetName(), existing.GetDownloadName()},
+		}
+		// Every version of the module needs forgetting about where it was, as the selected one
+		// inherits from the others.
+		for _, mod := range vd.versions {
+			mod.buildDir, mod.Name = "", ""
+		}
+		moved = append(moved, existing)
+	}
+	return moved
+}
+
+// relabel returns the labels of the moved modules' rules, keyed by their old labels.
+func (d *Directory) relabel() map[string]string {
+	labels := map[string]string{}
+	for modPath, old := range d.moved {
+		mod := d.GetSelected(modPath)
+		if mod == nil {
+			continue
+		}
+		labels[old.label] = mod.GetFullyQualifiedName()
+		oldPkg := old.label[:strings.LastIndex(old.label, ":")]
+		labels[oldPkg+":"+old.names[1]] = mod.GetFullyQualifiedDownloadName()
+	}
+	return labels
+}
+
+// rewriteLabels updates every reference to a moved rule in the BUILD files of the repo, which
+// is assumed to be the working directory. Files that have already been rendered are updated in
+// place, and any others that change are added to rendered.
+func (d *Directory) rewriteLabels(rendered map[string]*buildfile.File) error {
+	labels := d.relabel()
+	if len(labels) == 0 {
+		return nil
+	}
+	err := buildfile.Walk(".", func(buildPath string) error {
+		file, ok := rendered[buildPath]
+		if !ok {
+			var err error
+			file, err = buildfile.ParseFile(buildPath)
+			if err != nil {
+				return err
+			}
+		}
+		pkg := filepath.ToSlash(filepath.Dir(buildPath))
+		if pkg == "." {
+			pkg = ""
+		}
+		changed, err := file.ReplaceStrings(func(value string) (string, bool) {
+			label, ok := labels[canonicalLabel(value, pkg)]
+			if !ok {
+				return "", false
+			}
+			if strings.HasPrefix(label, "//"+pkg+":") {
+				return label[len(pkg)+2:], true
+			}
+			return label, true
+		})
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("Updating the labels of moved rules in %s\n", buildPath)
+			rendered[buildPath] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update references to moved rules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package module
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// moveRepo has foo and bar in the per-org layout, a hand written rule called foo where the
+// single layout puts everything, and a rule in the repo using foo.
+var moveRepo = map[string]string{
+	"third_party/go/example.com/BUILD": moduleRule("foo", "example.com/foo", "v1.0.0", ":bar") + "\n" +
+		moduleRule("bar", "example.com/bar", "v1.0.0"),
+	"third_party/go/BUILD": "filegroup(\n    name = \"foo\",\n    srcs = [\"foo.txt\"],\n)\n",
+	"app/BUILD":            "go_library(\n    name = \"app\",\n    deps = [\"//third_party/go/example.com:foo\"],\n)\n",
+}
+
+func TestMoveWhenTheTargetNameIsTaken(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), moveRepo, func(d *Directory) {
+		d.Layout = LayoutSingle
+	})
+
+	moved := d.Move()
+	if got := removedPaths(moved); got != "example.com/bar example.com/foo" {
+		t.Fatalf("Move() moved %s, want bar and foo", got)
+	}
+	selectExisting(d)
+	if err := d.assignNames(); err != nil {
+		t.Fatalf("assignNames() failed: %v", err)
+	}
+	if err := d.ExportBuildRules(FileWriter{}); err != nil {
+		t.Fatalf("ExportBuildRules() failed: %v", err)
+	}
+
+	// The hand written rule keeps its name, so foo gets another one, and everything using it
+	// follows it there.
+	build := readFile(t, "third_party/go/BUILD")
+	for _, want := range []string{`name = "foo",`, `name = "foo_2",`, `name = "bar",`, `deps = ["//third_party/go:bar"],`} {
+		if !strings.Contains(build, want) {
+			t.Errorf("third_party/go/BUILD doesn't contain %s:\n%s", want, build)
+		}
+	}
+	if app := readFile(t, "app/BUILD"); !strings.Contains(app, `"//third_party/go:foo_2"`) {
+		t.Errorf("app/BUILD wasn't updated to use //third_party/go:foo_2:\n%s", app)
+	}
+	if _, err := os.Stat("third_party/go/example.com/BUILD"); !os.IsNotExist(err) {
+		t.Errorf("third_party/go/example.com/BUILD is still there, want it removed: %v", err)
+	}
+}
+
+func TestMoveNothingToMove(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), moveRepo)
+
+	if moved := d.Move(); len(moved) != 0 {
+		t.Errorf("Move() moved %s, want nothing as it's already in the per-org layout", removedPaths(moved))
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, name := range []string{"single", "per-host", "per-org", "per-module"} {
+		if layout, err := ParseLayout(name); err != nil || string(layout) != name {
+			t.Errorf("ParseLayout(%q) = %q, %v, want %q", name, layout, err, name)
+		}
+	}
+	if _, err := ParseLayout("per-repo"); err == nil {
+		t.Errorf("ParseLayout(\"per-repo\") succeeded, want an error")
+	}
+}
@@ -0,0 +1,186 @@
+package module
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LockFileName is the name of the lock file in the third party directory.
+const LockFileName = "go-deps.lock"
+
+// Lock records the result of resolving the third party directory, so that later runs pick
+// the same versions instead of whatever happens to be the latest version at the time.
+type Lock struct {
+	// Roots are the modules everything else is needed for, in path@version form.
+	Roots []string
+	// Main is the main module, if the roots are the requirements from its go.mod. Its go
+	// version decides how the module graph is pruned, so later runs need it to pick the same
+	// versions without the go.mod.
+	Main    *LockedMain `json:",omitempty"`
+	Modules []LockedModule
+}
+
+// LockedMain is the main module the roots were required by.
+type LockedMain struct {
+	Path      string
+	GoVersion string
+}
+
+// LockedModule is a selected module, along with its hashes and the target of its rule.
+type LockedModule struct {
+	Path     string
+	Version  string
+	Sum      string
+	GoModSum string
+	Target   string
+	// Replace is the module downloaded in place of this one, in path@version form, if it
+	// has been replaced.
+	Replace string `json:",omitempty"`
+	// Inferred are the paths of the modules this one was found to need from its imports,
+	// rather than from its go.mod.
+	Inferred []string `json:",omitempty"`
+}
+
+// LoadLock reads the lock file at path, if there is one. The locked versions are used for
+// any roots without a version, and for any requirements that have to be inferred, unless
+// we're updating, in which case only the roots, main module, replacements and hashes are
+// kept. The locked hashes are checked against like the ones in go.sum. This needs to happen
+// before the rules on disk are loaded, as the lock has the versions of the modules replaced
+// by forks.
+func (d *Directory) LoadLock(path string, update bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lock file: %w", err)
+	}
+	lock := &Lock{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return fmt.Errorf("failed to parse lock file %s: %w", path, err)
+	}
+
+	for _, root := range lock.Roots {
+		d.lockedRoots[strings.Split(root, "@")[0]] = struct{}{}
+	}
+	if lock.Main != nil && d.mainModule == nil {
+		d.mainModule = &Module{Path: lock.Main.Path, goVersion: lock.Main.GoVersion}
+	}
+	for _, mod := range lock.Modules {
+		if !update {
+			d.locked[mod.Path] = mod.Version
+		}
+		if len(mod.Inferred) > 0 {
+			d.lockedInferred[mod.Path] = mod.Inferred
+		}
+		download := mod.Path + " " + mod.Version
+		if mod.Replace != "" {
+			download = strings.Replace(mod.Replace, "@", " ", 1)
+			parts := strings.SplitN(mod.Replace, "@", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("%s: %s is replaced by %q, which isn't in path@version form", path, mod.Path, mod.Replace)
+			}
+			// Only forks need remembering, as the version a module is replaced with is already
+			// the version in its rule, and pins from the module config are applied every run.
+			if parts[0] != mod.Path {
+				d.lockedReplacements[mod.Path] = Replacement{OldPath: mod.Path, NewPath: parts[0], NewVersion: parts[1]}
+			}
+		}
+		for key, sum := range map[string]string{download: mod.Sum, download + "/go.mod": mod.GoModSum} {
+			if sum == "" {
+				continue
+			}
+			if err := d.addSum(key, sum); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lockedOwner returns the locked module providing the import path, if there is one.
+func (d *Directory) lockedOwner(importPath string) *Module {
+	var owner *Module
+	for path, version := range d.locked {
+		if importPath != path && !strings.HasPrefix(importPath, path+"/") {
+			continue
+		}
+		if owner == nil || len(path) > len(owner.Path) {
+			owner = &Module{Path: path, Version: version}
+		}
+	}
+	return owner
+}
+
+// Lock returns the lock for the directory. Once it has been resolved, this is the selected
+// modules, otherwise it's what's on disk, less anything that is being removed.
+func (d *Directory) Lock() *Lock {
+	mods := d.Modules()
+	if !d.resolved {
+		mods = []*Module{}
+		for _, mod := range d.existingModules() {
+			if _, ok := d.removed[mod.Path]; !ok {
+				mods = append(mods, mod)
+			}
+		}
+		sort.Slice(mods, func(i, j int) bool {
+			return mods[i].Path < mods[j].Path
+		})
+	}
+
+	lock := &Lock{
+		Roots:   []string{},
+		Modules: make([]LockedModule, 0, len(mods)),
+	}
+	for _, root := range d.Roots() {
+		if mod := d.GetSelected(root.Path); mod != nil {
+			root = mod
+		}
+		lock.Roots = append(lock.Roots, root.String())
+	}
+	lock.Roots = dedupe(lock.Roots)
+	if d.mainModule != nil {
+		lock.Main = &LockedMain{Path: d.mainModule.Path, GoVersion: d.mainModule.goVersion}
+	}
+	for _, mod := range mods {
+		locked := LockedModule{
+			Path:     mod.Path,
+			Version:  mod.Version,
+			Sum:      mod.Sum,
+			GoModSum: mod.GoModSum,
+			Target:   mod.GetFullyQualifiedName(),
+		}
+		if mod.replace != nil {
+			locked.Replace = mod.replace.String()
+		}
+		if d.resolved {
+			locked.Inferred = mod.inferred()
+		} else {
+			locked.Inferred = d.lockedInferred[mod.Path]
+		}
+		if locked.Sum == "" {
+			// Modules that weren't downloaded this time round keep the hashes we already knew.
+			locked.Sum = d.sums[mod.GetDownloadPath()+" "+mod.GetDownloadVersion()]
+		}
+		if locked.GoModSum == "" {
+			locked.GoModSum = d.sums[mod.GetDownloadPath()+" "+mod.GetDownloadVersion()+"/go.mod"]
+		}
+		lock.Modules = append(lock.Modules, locked)
+	}
+	return lock
+}
+
+// WriteLock writes the lock file into the third party directory with the writer.
+func (d *Directory) WriteLock(writer Writer) error {
+	data, err := json.MarshalIndent(d.Lock(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lock file: %w", err)
+	}
+	return writer.WriteFile(filepath.Join(d.thirdParty, LockFileName), append(data, '\n'))
+}
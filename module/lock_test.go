@@ -0,0 +1,118 @@
+package module
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lockRepo has foo on disk, replaced by a fork, and bar, along with the lock file for them.
+var lockRepo = map[string]string{
+	"third_party/go/example.com/BUILD": `go_mod_download(
+    name = "foo_download",
+    labels = ["go_sum:h1:fork="],
+    module = "example.com/fork",
+    version = "v1.0.1",
+)
+
+go_module(
+    name = "foo",
+    download = ":foo_download",
+    module = "example.com/foo",
+    deps = [":bar"],
+)
+
+` + moduleRule("bar", "example.com/bar", "v1.2.0"),
+	"third_party/go/go-deps.lock": `{
+  "Roots": ["example.com/foo@v1.0.0"],
+  "Modules": [
+    {
+      "Path": "example.com/bar",
+      "Version": "v1.2.0",
+      "Sum": "h1:bar=",
+      "GoModSum": "h1:barmod=",
+      "Target": "//third_party/go/example.com:bar"
+    },
+    {
+      "Path": "example.com/foo",
+      "Version": "v1.0.0",
+      "Sum": "h1:fork=",
+      "GoModSum": "",
+      "Target": "//third_party/go/example.com:foo",
+      "Replace": "example.com/fork@v1.0.1"
+    }
+  ]
+}
+`,
+}
+
+func TestLoadLock(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), lockRepo)
+
+	if want := map[string]string{"example.com/bar": "v1.2.0", "example.com/foo": "v1.0.0"}; !reflect.DeepEqual(d.locked, want) {
+		t.Errorf("locked versions = %v, want %v", d.locked, want)
+	}
+	// The fork's rule only has the fork's version, so the version it replaces comes from the lock.
+	if foo := d.Get("example.com/foo").existing(); foo == nil || foo.Version != "v1.0.0" {
+		t.Errorf("loaded foo = %v, want example.com/foo@v1.0.0", foo)
+	}
+	if got := d.sums["example.com/bar v1.2.0/go.mod"]; got != "h1:barmod=" {
+		t.Errorf("locked go.mod hash of bar = %q, want h1:barmod=", got)
+	}
+
+	// Without resolving, the lock is just what was loaded.
+	got, err := json.Marshal(d.Lock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Lock{}
+	if err := json.Unmarshal([]byte(lockRepo["third_party/go/go-deps.lock"]), want); err != nil {
+		t.Fatal(err)
+	}
+	if wantJSON, _ := json.Marshal(want); string(got) != string(wantJSON) {
+		t.Errorf("Lock() = %s, want %s", got, wantJSON)
+	}
+}
+
+func TestLoadLockErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		lock string
+		want string
+	}{
+		{
+			name: "malformed",
+			lock: `{"Roots": [`,
+			want: "failed to parse lock file",
+		},
+		{
+			name: "replacement without a version",
+			lock: `{"Modules": [{"Path": "example.com/foo", "Version": "v1.0.0", "Replace": "example.com/fork"}]}`,
+			want: `example.com/foo is replaced by "example.com/fork", which isn't in path@version form`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inRepo(t, map[string]string{"third_party/go/go-deps.lock": test.lock})
+			err := NewResolver("third_party/go", newFakeFetcher(), FileWriter{}).LoadLock(false)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("LoadLock() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadLockConflictingHashes(t *testing.T) {
+	inRepo(t, withFiles(lockRepo, map[string]string{
+		"third_party/go/example.com/BUILD": strings.Replace(lockRepo["third_party/go/example.com/BUILD"], "h1:fork=", "h1:tampered=", 1),
+	}))
+	r := NewResolver("third_party/go", newFakeFetcher(), FileWriter{})
+	if err := r.LoadLock(false); err != nil {
+		t.Fatalf("LoadLock() failed: %v", err)
+	}
+	err := r.Load()
+	if err == nil || !strings.Contains(err.Error(), "conflicting hashes for example.com/fork v1.0.1") {
+		t.Errorf("Load() error = %v, want the rule's hash to conflict with the lock's", err)
+	}
+}
@@ -0,0 +1,170 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/jamesjarvis/go-deps/buildfile"
+)
+
+// migratedAttrs are the go_get attributes we know how to carry over to go_module, and whether
+// they have to be a plain list of strings to do so. Rules with anything else, like hashes which
+// would be for the wrong outputs, are left alone.
+var migratedAttrs = map[string]bool{
+	"name":          false,
+	"get":           false,
+	"revision":      false,
+	"patch":         false,
+	"binary":        false,
+	"test_only":     false,
+	"install":       true,
+	"deps":          true,
+	"exported_deps": true,
+	"licences":      true,
+	"strip":         true,
+	"labels":        true,
+	"visibility":    true,
+}
+
+// MigrateGoGetRules finds all of the go_get rules in the BUILD files under root, and
+// rewrites them in place as go_module rules with the same name.
+func MigrateGoGetRules(ctx context.Context, fetcher Fetcher, writer Writer, root string) error {
+	return buildfile.Walk(root, func(path string) error {
+		return migrateBuildFile(ctx, fetcher, writer, path)
+	})
+}
+
+func migrateBuildFile(ctx context.Context, fetcher Fetcher, writer Writer, buildFilePath string) error {
+	file, err := buildfile.ParseFile(buildFilePath)
+	if err != nil {
+		return err
+	}
+	rules := file.Rules("go_get")
+	if len(rules) == 0 {
+		return nil
+	}
+
+	migratedAny := false
+	for _, rule := range rules {
+		if rule.AttrString("get") == "" || rule.AttrString("repo") != "" {
+			log.Printf("Skipping go_get %q in %s, we can only migrate rules fetching a single package path\n", rule.Name(), buildFilePath)
+			continue
+		}
+		if attr := unmigratedAttr(rule); attr != "" {
+			log.Printf("Warning: skipping go_get %q in %s, we don't know how to migrate its %s attribute\n", rule.Name(), buildFilePath, attr)
+			continue
+		}
+		mod, migrated, err := migrateGoGetRule(ctx, fetcher, rule)
+		if err != nil {
+			return fmt.Errorf("failed to migrate go_get %q in %s: %w", rule.Name(), buildFilePath, err)
+		}
+		file.Replace(rule, string(formatRules([]*build.Rule{migrated})))
+		log.Printf("Migrated %s:%s to %s@%s\n", buildFilePath, rule.Name(), mod.Path, mod.Version)
+		migratedAny = true
+	}
+
+	// Leave the file alone if we couldn't migrate anything in it.
+	if !migratedAny {
+		return nil
+	}
+	return writer.WriteFile(buildFilePath, file.Bytes())
+}
+
+// migrateGoGetRule works out which module and version the go_get rule is fetching, and returns
+// the go_module rule to replace it with. Unlike the rules we generate from scratch, the deps are
+// kept as the labels the go_get rule used.
+func migrateGoGetRule(ctx context.Context, fetcher Fetcher, rule *buildfile.Rule) (*Module, *build.Rule, error) {
+	get := rule.AttrString("get")
+	pkgPath := strings.TrimSuffix(get, "/...")
+
+	mod, err := findModule(ctx, fetcher, pkgPath, rule.AttrString("revision"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The go_get install list is relative to the package being fetched, whereas go_module
+	// wants them relative to the module root.
+	relPkg := strings.TrimPrefix(strings.TrimPrefix(pkgPath, mod.Path), "/")
+	installs := rule.AttrStrings("install")
+	if len(installs) == 0 {
+		installs = []string{""}
+		if strings.HasSuffix(get, "/...") {
+			installs = []string{"..."}
+		}
+	}
+	install := make([]string, 0, len(installs))
+	for _, pkg := range installs {
+		pkg = path.Join(relPkg, pkg)
+		if pkg == "" {
+			pkg = "."
+		}
+		install = append(install, pkg)
+	}
+
+	migrated := newRule("go_module", rule.Name())
+	setString(migrated, "module", mod.Path)
+	setString(migrated, "version", mod.Version)
+	for _, key := range []string{"deps", "exported_deps", "licences", "strip", "labels", "visibility"} {
+		setStrings(migrated, key, rule.AttrStrings(key))
+	}
+	// These needn't be literals, so the expressions are kept as they are.
+	for _, key := range []string{"patch", "binary", "test_only"} {
+		if expr := rule.Attr(key); expr != nil {
+			migrated.SetAttr(key, expr)
+		}
+	}
+	setStrings(migrated, "install", install)
+	return mod, migrated, nil
+}
+
+// unmigratedAttr returns the first attribute of the go_get rule we can't carry over to a
+// go_module, or an empty string if there aren't any.
+func unmigratedAttr(rule *buildfile.Rule) string {
+	for _, key := range rule.AttrKeys() {
+		list, ok := migratedAttrs[key]
+		if !ok || (list && !isStringList(rule.Attr(key))) {
+			return key
+		}
+	}
+	return ""
+}
+
+// isStringList returns whether the expression is a list of string literals.
+func isStringList(expr build.Expr) bool {
+	list, ok := expr.(*build.ListExpr)
+	if !ok {
+		return false
+	}
+	for _, elem := range list.List {
+		if _, ok := elem.(*build.StringExpr); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// findModule returns the module providing the package at the given revision, by trying
+// each parent of the package path in turn, starting with the longest.
+func findModule(ctx context.Context, fetcher Fetcher, pkgPath, revision string) (*Module, error) {
+	if revision == "" {
+		revision = "latest"
+	}
+	splitPath := strings.Split(pkgPath, "/")
+	var errs []string
+	for i := len(splitPath); i >= 2; i-- {
+		mod := &Module{
+			Path:    strings.Join(splitPath[:i], "/"),
+			Version: revision,
+		}
+		err := mod.Download(ctx, fetcher)
+		if err == nil {
+			return mod, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("unable to find a module providing %s@%s: %s", pkgPath, revision, strings.Join(errs, "; "))
+}
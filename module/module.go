@@ -1,79 +1,68 @@
 package module
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
-	"text/template"
 
 	"github.com/jamesjarvis/go-deps/host"
 	"golang.org/x/mod/modfile"
-	"golang.org/x/mod/semver"
-)
-
-const goModuleTemplateString = `
-go_module(
-  name = "{{ .GetName }}",
-  module = "{{ .Path }}",
-  version = "{{ .Version }}",
-  deps = [
-    {{- range .Deps }}
-    "{{ .GetFullyQualifiedName }}",
-    {{- end }}
-  ],
-  visibility = ["PUBLIC"],
-  install = ["..."],
-)
-`
-
-const goModuleDownloadTemplateString = `
-go_mod_download(
-  name = "{{ .GetDownloadName }}",
-  module = "{{ .Path }}",
-  version = "{{ .Version }}",
-  deps = [
-    {{- range .Deps }}
-    "{{ .GetFullyQualifiedName }}",
-    {{- end }}
-  ],
-  visibility = ["PUBLIC"],
-)
-
-go_module(
-  name = "{{ .GetName }}",
-  module = "{{ .Path }}",
-  download = "{{ .GetFullyQualifiedDownloadName }}",
-  visibility = ["PUBLIC"],
-  install = ["..."],
-)
-`
-
-var (
-	goModuleTemplater = template.Must(template.New("go_module").Parse(goModuleTemplateString))
-	goModuleDownloadTemplater = template.Must(template.New("go_mod_download").Parse(goModuleDownloadTemplateString))
 )
 
 // Module is the module object we want to add to the project, essentially just the module path
 // and any required information for fetching the module (such as version).
 type Module struct {
-	Path string
+	Path    string
 	Version string
-	Name string
+	Name    string
+	// Install is the list of packages to install, relative to the module root.
+	Install []string
 
 	Deps []*Module
 
+	// replace is the module this one has been replaced with by a replace directive, if any.
+	replace *Module
+
+	// requires is every module required by this module's go.mod, including indirect requirements.
+	requires []Requirement
+	// goVersion is the go version its go.mod declares, which decides whether the requirements
+	// of its requirements are pruned from the module graph.
+	goVersion string
+
+	// thirdParty is the third party directory the module's rule is written to, relative to
+	// the repo root, and layout decides where in there it goes.
+	thirdParty string
+	layout     Layout
+	// buildDir is the directory of the BUILD file this module is defined in, if it was
+	// loaded from an existing BUILD file.
+	buildDir string
+	// existingVersion is the version of this module that is already written to disk, if any,
+	// and fromDisk is set on the module that was loaded from there.
+	existingVersion string
+	fromDisk        bool
+	// existingDeps are the labels of the deps of the rule already written to disk, and
+	// existingInstall is its install list.
+	existingDeps    []string
+	existingInstall []string
+	// config is the overrides for the module from the module config file, if it has any.
+	config *ModuleConfig
+
+	// Sum and GoModSum are the go.sum style h1: hashes of the module's zip and go.mod file.
+	Sum      string
+	GoModSum string
+
 	downloaded bool
-	nameWithVersion bool
-	info string
+	// pkgs caches the packages found in the downloaded module.
+	pkgs  map[string]*Package
+	info  string
 	goMod string
-	dir string
-	sum string
-	goModSum string
+	dir   string
 }
 
 // String returns a string representation of the module, with the module name and version.
@@ -84,196 +73,271 @@ func (m *Module) String() string {
 	return fmt.Sprintf("%s@%s", m.Path, m.Version)
 }
 
-// GetName returns a please friendly name for the module, with info of the version if
-// multiple versions of the same module exist.
-func (m *Module) GetName() string {
-	if m.Name != "" {
-		return m.Name
-	}
-	splitPath := strings.Split(m.Path, "/")
-	modName := splitPath[len(splitPath)-1]
-	if splitPath[0] == "github.com" {
-		modName = strings.Join(splitPath[2:], "_")
+// GetDownloadPath returns the path of the module to download, which is different to the
+// module path if it has been replaced with a fork.
+func (m *Module) GetDownloadPath() string {
+	if m.replace != nil {
+		return m.replace.Path
 	}
-	if m.nameWithVersion {
-		return modName + "_" + semver.Major(m.Version)
-	}
-	return modName
+	return m.Path
 }
 
-// GetDownloadName returns a please friendly name for the module's go_mod_download rule.
-func (m *Module) GetDownloadName() string {
-	return m.GetName() + "_" + "download"
+// GetDownloadVersion returns the version of the module to download, which is different to
+// the selected version if it has been replaced.
+func (m *Module) GetDownloadVersion() string {
+	if m.replace != nil {
+		return m.replace.Version
+	}
+	return m.Version
 }
 
-// GetBuildPath returns the path to the please BUILD file where this module is defined.
-func (m *Module) GetBuildPath(thirdParty string) string {
-	return filepath.Join(thirdParty, filepath.Dir(m.Path), "BUILD")
+// GetSumLabels returns the labels recording the module's hashes in its rule. Please never
+// checks these, and its hashes attribute is over the extracted module the rules output rather
+// than the zip, so there's nothing we could put there that it would check. They're only
+// verified by go-deps when it downloads the module, which includes every run of check.
+func (m *Module) GetSumLabels() []string {
+	labels := []string{}
+	if m.Sum != "" {
+		labels = append(labels, sumLabelPrefix+m.Sum)
+	}
+	if m.GoModSum != "" {
+		labels = append(labels, goModSumLabelPrefix+m.GoModSum)
+	}
+	return labels
 }
 
-// GetFullyQualifiedName returns the please build target for this module.
-func (m *Module) GetFullyQualifiedName() string {
-	splitPath := strings.Split(m.Path, "/")
-	pathMinusEnd := strings.Join(splitPath[:len(splitPath)-1], "/")
-	if splitPath[0] == "github.com" {
-		pathMinusEnd = strings.Join(splitPath[:2], "/")
+// GetInstall returns the packages to install for the module, defaulting to all of them.
+func (m *Module) GetInstall() []string {
+	if len(m.Install) == 0 {
+		return []string{"..."}
 	}
-	buildDir := fmt.Sprintf("third_party/go/%s", pathMinusEnd)
-	return "//" + buildDir + ":" + m.GetName()
+	return m.Install
 }
 
-// GetFullyQualifiedDownloadName returns the please build target for this module's go_mod_download rule.
-func (m *Module) GetFullyQualifiedDownloadName() string {
-	splitPath := strings.Split(m.Path, "/")
-	pathMinusEnd := strings.Join(splitPath[:len(splitPath)-1], "/")
-	if splitPath[0] == "github.com" {
-		pathMinusEnd = strings.Join(splitPath[:2], "/")
+// inherit carries over the details of an existing definition of this module, so that
+// replacing it keeps the same target. The install list isn't carried over, as the packages
+// of the new version can be different.
+func (m *Module) inherit(existing *Module) {
+	if m == existing {
+		return
+	}
+	if m.Name == "" {
+		m.Name = existing.Name
+	}
+	if m.buildDir == "" {
+		m.buildDir = existing.buildDir
+	}
+	if m.existingVersion == "" {
+		m.existingVersion = existing.existingVersion
 	}
-	buildDir := fmt.Sprintf("third_party/go/%s", pathMinusEnd)
-	return "//" + buildDir + ":" + m.GetDownloadName()
 }
 
-// WriteGoModuleRule accepts an io.Writer interface and write the go_module build definition
-// for this module to it.
-func (m *Module) WriteGoModuleRule(wr io.Writer) error {
-	if m.nameWithVersion {
-		return goModuleDownloadTemplater.Execute(wr, m)
+// Download downloads the go module into the cache directory.
+func (m *Module) Download(ctx context.Context, fetcher Fetcher) error {
+	if m.replace != nil {
+		err := m.replace.Download(ctx, fetcher)
+		if err != nil {
+			return err
+		}
+		m.downloaded = true
+		m.info, m.goMod, m.GoModSum = m.replace.info, m.replace.goMod, m.replace.GoModSum
+		m.Sum, m.dir = m.replace.Sum, m.replace.dir
+		return nil
 	}
-	return goModuleTemplater.Execute(wr, m)
-}
 
-// Download downloads the go module into a temporary directory
-func (m *Module) Download(ctx context.Context) error {
-	downloadedModule, err := host.GoModDownload(ctx, m.String())
+	downloadedModule, err := fetcher.Download(ctx, m.Path, m.query())
 	if err != nil {
 		return fmt.Errorf("failed to download go module: %w", err)
 	}
 
 	m.downloaded = true
+	m.setGoMod(downloadedModule)
+	m.Sum = downloadedModule.Sum
+	m.dir = downloadedModule.Dir
+
+	log.Printf("Downloaded: %q\n", m.String())
+
+	return nil
+}
+
+// DownloadGoMod downloads just the go.mod file of the module, which is all we need to
+// work out its requirements.
+func (m *Module) DownloadGoMod(ctx context.Context, fetcher Fetcher) error {
+	if m.replace != nil {
+		err := m.replace.DownloadGoMod(ctx, fetcher)
+		if err != nil {
+			return err
+		}
+		m.info, m.goMod, m.GoModSum = m.replace.info, m.replace.goMod, m.replace.GoModSum
+		return nil
+	}
+
+	downloadedModule, err := fetcher.DownloadGoMod(ctx, m.Path, m.query())
+	if err != nil {
+		return fmt.Errorf("failed to download go.mod: %w", err)
+	}
+	m.setGoMod(downloadedModule)
+	return nil
+}
+
+// query returns the version query to fetch the module with, which is the latest version
+// if we haven't been given one.
+func (m *Module) query() string {
 	if m.Version == "" {
+		return "latest"
+	}
+	return m.Version
+}
+
+func (m *Module) setGoMod(downloadedModule *host.GoModDownloadResponse) {
+	// Take the resolved version, as we may have asked for a query such as a commit hash
+	// or "latest". Canonical versions are left alone, as they may be being read elsewhere.
+	if m.Version != downloadedModule.Version {
 		m.Version = downloadedModule.Version
 	}
 	m.info = downloadedModule.Info
 	m.goMod = downloadedModule.GoMod
-	m.goModSum = downloadedModule.GoModSum
-	m.sum = downloadedModule.Sum
-	m.dir = downloadedModule.Dir
+	m.GoModSum = downloadedModule.GoModSum
+}
 
-	// Add self to cache
-	storedModule := GlobalCache.SetModule(m)
-	if storedModule != m {
-		log.Printf("Dependencies change! We started with %s and now have %s", m, storedModule)
-		m = storedModule
+// fetchRequirements fetches the module if we haven't already, and reads the requirements
+// from its go.mod file.
+func (m *Module) fetchRequirements(ctx context.Context, fetcher Fetcher) error {
+	if m.requires != nil {
+		return nil
+	}
+	if m.goMod == "" {
+		err := m.DownloadGoMod(ctx, fetcher)
+		if err != nil {
+			return err
+		}
 	}
+	var err error
+	m.requires, err = m.readRequirements()
+	return err
+}
 
-	log.Printf("Downloaded: %q\n", m.String())
+// requirement returns the requirement of this module on the module at path.
+func (m *Module) requirement(path string) (Requirement, bool) {
+	for _, req := range m.requires {
+		if req.Path == path {
+			return req, true
+		}
+	}
+	return Requirement{}, false
+}
 
-	return nil
+// hasGoMod returns whether the downloaded module has its own go.mod file. Modules without
+// one get a go.mod synthesised by the proxy, which doesn't have any requirements in it.
+func (m *Module) hasGoMod() bool {
+	if m.dir == "" {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(m.dir, "go.mod"))
+	return err == nil
 }
 
-// GetDependencies returns the direct dependencies of Module m.
-func (m *Module) GetDependencies() ([]*Module, error) {
-	if !m.downloaded {
-		return nil, fmt.Errorf("module %s has not been downloaded yet", m.String())
+// packages returns the packages in the downloaded module for the platform, or nil if it
+// hasn't been downloaded yet.
+func (m *Module) packages(platform Platform) (map[string]*Package, error) {
+	if m.pkgs != nil || m.dir == "" {
+		return m.pkgs, nil
+	}
+	pkgs, err := scanPackages(m.dir, platform)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan packages of %s: %w", m.String(), err)
 	}
+	m.pkgs = pkgs
+	return pkgs, nil
+}
 
+// readGoMod parses the go.mod file of Module m, returning the go version it declares too. Lax
+// parsing ignores everything but the module and require directives, which is all that matters
+// for dependencies.
+func (m *Module) readGoMod(lax bool) (*modfile.File, string, error) {
 	modulePath := m.goMod
 	if modulePath == "" {
-		return nil, fmt.Errorf("go.mod path not set: %s", modulePath)
+		return nil, "", fmt.Errorf("go.mod of module %s has not been downloaded yet", m.String())
 	}
 
 	goModBytes, err := ioutil.ReadFile(modulePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read go.mod file: %w", err)
+		return nil, "", fmt.Errorf("failed to read go.mod file: %w", err)
 	}
+	return parseGoMod(modulePath, goModBytes, lax)
+}
 
-	goMod, err := modfile.ParseLax(modulePath, goModBytes, nil)
+// readRequirements returns every requirement in the go.mod file of Module m, and records the
+// go version it declares.
+func (m *Module) readRequirements() ([]Requirement, error) {
+	goMod, goVersion, err := m.readGoMod(true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse go.mod file: %w", err)
+		return nil, err
 	}
+	m.goVersion = goVersion
 
-	modules := []*Module{}
+	requires := make([]Requirement, 0, len(goMod.Require))
 	for _, mod := range goMod.Require {
-		if mod.Indirect {
-			// We don't care about indirect modules tbh.
-			continue
-		}
-
-		modules = append(modules, &Module{
-			Path: mod.Mod.Path,
-			Version: mod.Mod.Version,
+		requires = append(requires, Requirement{
+			Path:     mod.Mod.Path,
+			Version:  mod.Mod.Version,
+			Indirect: mod.Indirect,
 		})
 	}
 
-	m.Deps = modules
-
-	return modules, nil
+	return requires, nil
 }
 
-// GetDependenciesRecursively downloads and stores the dependencies of the specified module, and all of
-// it's dependencies. You should only need to call this once at the root module, but if you call it
-// multiple times that should be a no-op.
-func (m *Module) GetDependenciesRecursively(ctx context.Context) ([]*Module, error) {
-	// We start a goroutine to pass the modules we want to fetch to.
-	// This goroutine is then self populated by the dependencies it then fetches.
-	// Each time it fetches one, it calls wg.Done, and each time it adds one, it
-	// calls wg.Add.
-	// Once the waitgroup is done, the channel is closed, killing the worker.
-	// This implementation technically has a deadlock case, as if there are modules
-	// with thousands of dependencies, it will get stuck waiting to send on the 
-	// channel it is consuming from.
-	allModules := []*Module{}
-	modules := make(chan *Module, 1000)
-
-	seenMap := map[string]struct{}{}
-
-	var wg sync.WaitGroup
-	var groupError error
-	go func(ctx context.Context){
-		for mod := range modules {
-			if _, seen := seenMap[mod.String()]; seen {
-				// We have seen this before...
-				wg.Done()
-				continue
-			}
-			if groupError != nil {
-				// If we encounter an error from any one of the dependency fetchers, we short circuit.
-				wg.Done()
-				continue
-			}
-			err := mod.Download(ctx)
-			if err != nil {
-				groupError = err
-				wg.Done()
-				continue
-			}
-			fetchedModules, err := mod.GetDependencies()
-			if err != nil {
-				groupError = err
-				wg.Done()
-				continue
+// parseGoMod parses a go.mod file, along with the go version it declares. Newer go versions
+// write go directives in formats (such as "go 1.21.0") the parser can't handle, and add a
+// toolchain directive it doesn't know about, so those lines are taken out before parsing and
+// the go version is read from them by hand instead.
+func parseGoMod(path string, data []byte, lax bool) (*modfile.File, string, error) {
+	goVersion := ""
+	lines := bytes.Split(data, []byte("\n"))
+	kept := lines[:0]
+	for _, line := range lines {
+		fields := strings.Fields(string(line))
+		if len(fields) > 0 && (fields[0] == "go" || fields[0] == "toolchain") {
+			if fields[0] == "go" && len(fields) > 1 {
+				goVersion = fields[1]
 			}
-			for _, fetchedMod := range fetchedModules {
-				wg.Add(1)
-				modules <- fetchedMod
-			}
-			allModules = append(allModules, fetchedModules...)
-			// Mark this module as seen.
-			seenMap[mod.String()] = struct{}{}
-			wg.Done()
+			continue
 		}
-	}(ctx)
+		kept = append(kept, line)
+	}
 
-	// Send initial module.
-	wg.Add(1)
-	modules <- m
+	parse := modfile.Parse
+	if lax {
+		parse = modfile.ParseLax
+	}
+	goMod, err := parse(path, bytes.Join(kept, []byte("\n")), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse go.mod file: %w", err)
+	}
+	return goMod, goVersion, nil
+}
 
-	// Wait for results and close sending channel.
-	wg.Wait()
-	close(modules)
-	
-	if groupError != nil {
-		return nil, groupError
+// pruned returns whether the module's go.mod says go 1.17 or later, from when go.mod files list
+// every module needed to build the packages in the module, so the module graph can be pruned
+// below them. Modules without a go version count as older, as they do for go.
+func (m *Module) pruned() bool {
+	parts := strings.SplitN(m.goVersion, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	// The minor version can have a pre-release suffix, like 1.21rc1.
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	n, err := strconv.Atoi(minor)
+	if err != nil {
+		return false
 	}
-	return allModules, nil
+	return major > 1 || (major == 1 && n >= 17)
 }
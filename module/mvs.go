@@ -0,0 +1,101 @@
+package module
+
+import (
+	"sort"
+
+	"golang.org/x/mod/semver"
+)
+
+// Requirement is a single require directive from a go.mod file.
+type Requirement struct {
+	Path     string
+	Version  string
+	Indirect bool
+	// Inferred is set for requirements that weren't declared in a go.mod file, but were
+	// worked out from the module's imports instead.
+	Inferred bool
+}
+
+// String returns the requirement in path@version form.
+func (r Requirement) String() string {
+	return r.Path + "@" + r.Version
+}
+
+// BuildList returns the build list for the main modules using Minimal Version Selection,
+// which is the same algorithm `go build` uses to pick versions. The minimums are modules that
+// are selected at least at their version, without their requirements counting for anything.
+//
+// The requirements of the module versions in the requirement graph are visited, and for each
+// module path the highest version that anything requires is selected. Since major versions
+// from v2 upwards are part of the module path, this selects one version per major version of
+// each module. The returned list is sorted by module path.
+//
+// The graph is pruned the same way go does it from go 1.17. Modules whose go.mod says go 1.17
+// or later list everything needed to build their packages, so when a main module like that
+// requires one, only the requirements of what it requires are added to the graph, and not
+// what they require in turn. If either of them is an older module, everything reachable from
+// it is added, as it may not list everything it needs.
+//
+// The reqs function returns the modules required by a given module, it is not expected to
+// fetch anything, the graph should already have been loaded by this point.
+func BuildList(mains, minimums []*Module, reqs func(*Module) ([]*Module, error)) ([]*Module, error) {
+	selected := map[string]*Module{}
+	sel := func(mod *Module) {
+		if current, ok := selected[mod.Path]; !ok || semver.Compare(mod.Version, current.Version) > 0 {
+			selected[mod.Path] = mod
+		}
+	}
+
+	// A module can be reached pruned first, and then unpruned by some other route, in which
+	// case it's visited again to follow its requirements the rest of the way down.
+	type visit struct {
+		mod      *Module
+		unpruned bool
+	}
+	visited := map[string]bool{}
+	queue := []visit{}
+	for _, main := range mains {
+		sel(main)
+		required, err := reqs(main)
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range required {
+			queue = append(queue, visit{mod: req, unpruned: !main.pruned()})
+		}
+	}
+	for _, mod := range minimums {
+		sel(mod)
+	}
+
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if unpruned, ok := visited[v.mod.String()]; ok && (unpruned || !v.unpruned) {
+			continue
+		}
+		visited[v.mod.String()] = v.unpruned
+		sel(v.mod)
+
+		required, err := reqs(v.mod)
+		if err != nil {
+			return nil, err
+		}
+		follow := v.unpruned || !v.mod.pruned()
+		for _, req := range required {
+			sel(req)
+			if follow {
+				queue = append(queue, visit{mod: req, unpruned: true})
+			}
+		}
+	}
+
+	buildList := make([]*Module, 0, len(selected))
+	for _, mod := range selected {
+		buildList = append(buildList, mod)
+	}
+	sort.Slice(buildList, func(i, j int) bool {
+		return buildList[i].Path < buildList[j].Path
+	})
+	return buildList, nil
+}
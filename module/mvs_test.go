@@ -0,0 +1,252 @@
+package module
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// graph is a module graph for tests, from path@version to the path@versions it requires.
+type graph map[string][]string
+
+// reqs returns the requirements of a module in the graph. Modules that aren't in it don't
+// require anything.
+func (g graph) reqs(mod *Module) ([]*Module, error) {
+	required := make([]*Module, 0, len(g[mod.String()]))
+	for _, req := range g[mod.String()] {
+		required = append(required, parseModule(req))
+	}
+	return required, nil
+}
+
+func parseModule(s string) *Module {
+	parts := strings.SplitN(s, "@", 2)
+	return &Module{Path: parts[0], Version: parts[1]}
+}
+
+func TestBuildList(t *testing.T) {
+	// prunable is a graph where d@v1.1.0 is only in the graph if c's requirements are.
+	prunable := graph{
+		"a@v1.0.0": {"b@v1.0.0", "d@v1.0.0"},
+		"b@v1.0.0": {"c@v1.0.0"},
+		"c@v1.0.0": {"d@v1.1.0"},
+	}
+
+	tests := []struct {
+		name  string
+		graph graph
+		// goVersions are the go versions in the go.mod of each module, if they have one.
+		goVersions map[string]string
+		mains      []string
+		minimums   []string
+		want       []string
+	}{
+		{
+			name:  "no requirements",
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0"},
+		},
+		{
+			name: "diamond picks the highest version",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.1.0", "c@v1.0.0"},
+				"c@v1.0.0": {"b@v1.2.0"},
+			},
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0", "b@v1.2.0", "c@v1.0.0"},
+		},
+		{
+			name: "versions nothing requires aren't selected",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.0.0"},
+				"b@v1.1.0": {"c@v1.0.0"},
+			},
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0", "b@v1.0.0"},
+		},
+		{
+			name: "requirements of older versions are kept",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.0.0", "c@v1.0.0"},
+				"b@v1.0.0": {"d@v1.0.0"},
+				"c@v1.0.0": {"b@v1.1.0"},
+			},
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0", "b@v1.1.0", "c@v1.0.0", "d@v1.0.0"},
+		},
+		{
+			name: "major versions are different modules",
+			graph: graph{
+				"a@v1.0.0":    {"x@v1.5.0", "x/v2@v2.0.0"},
+				"x/v2@v2.0.0": {"x@v1.6.0"},
+			},
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0", "x@v1.6.0", "x/v2@v2.0.0"},
+		},
+		{
+			name: "cycles back to an older version of the target",
+			graph: graph{
+				"a@v1.1.0": {"b@v1.0.0"},
+				"b@v1.0.0": {"a@v1.0.0"},
+				"a@v1.0.0": {"b@v1.0.0", "c@v1.0.0"},
+			},
+			mains: []string{"a@v1.1.0"},
+			want:  []string{"a@v1.1.0", "b@v1.0.0", "c@v1.0.0"},
+		},
+		{
+			name: "several targets share a build list",
+			graph: graph{
+				"a@v1.0.0": {"c@v1.0.0"},
+				"b@v1.0.0": {"c@v1.2.0"},
+			},
+			mains: []string{"a@v1.0.0", "b@v1.0.0"},
+			want:  []string{"a@v1.0.0", "b@v1.0.0", "c@v1.2.0"},
+		},
+		{
+			name: "pseudo-versions are ordered before the release they're based on",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.2.0", "c@v1.0.0"},
+				"c@v1.0.0": {"b@v1.2.0-0.20200101000000-abcdefabcdef"},
+			},
+			mains: []string{"a@v1.0.0"},
+			want:  []string{"a@v1.0.0", "b@v1.2.0", "c@v1.0.0"},
+		},
+		{
+			// b's go.mod would list d if it needed it, so c's requirements don't count.
+			name:       "go 1.17 modules prune the requirements of their requirements",
+			graph:      prunable,
+			goVersions: map[string]string{"a@v1.0.0": "1.17", "b@v1.0.0": "1.17"},
+			mains:      []string{"a@v1.0.0"},
+			want:       []string{"a@v1.0.0", "b@v1.0.0", "c@v1.0.0", "d@v1.0.0"},
+		},
+		{
+			name:       "newer go versions prune too",
+			graph:      prunable,
+			goVersions: map[string]string{"a@v1.0.0": "1.21.0", "b@v1.0.0": "1.22rc1"},
+			mains:      []string{"a@v1.0.0"},
+			want:       []string{"a@v1.0.0", "b@v1.0.0", "c@v1.0.0", "d@v1.0.0"},
+		},
+		{
+			name:       "requirements of older modules aren't pruned",
+			graph:      prunable,
+			goVersions: map[string]string{"a@v1.0.0": "1.17", "b@v1.0.0": "1.16"},
+			mains:      []string{"a@v1.0.0"},
+			want:       []string{"a@v1.0.0", "b@v1.0.0", "c@v1.0.0", "d@v1.1.0"},
+		},
+		{
+			name:       "older main modules aren't pruned",
+			graph:      prunable,
+			goVersions: map[string]string{"b@v1.0.0": "1.17"},
+			mains:      []string{"a@v1.0.0"},
+			want:       []string{"a@v1.0.0", "b@v1.0.0", "c@v1.0.0", "d@v1.1.0"},
+		},
+		{
+			// b is pruned where a requires it, but e is older, so its requirement on b
+			// brings in everything below b too.
+			name: "pruned modules are followed when an older module requires them",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.0.0", "d@v1.0.0", "e@v1.0.0"},
+				"b@v1.0.0": {"c@v1.0.0"},
+				"c@v1.0.0": {"d@v1.1.0"},
+				"e@v1.0.0": {"b@v1.0.0"},
+			},
+			goVersions: map[string]string{"a@v1.0.0": "1.17", "b@v1.0.0": "1.17"},
+			mains:      []string{"a@v1.0.0"},
+			want:       []string{"a@v1.0.0", "b@v1.0.0", "c@v1.0.0", "d@v1.1.0", "e@v1.0.0"},
+		},
+		{
+			name: "minimums don't bring in their requirements",
+			graph: graph{
+				"a@v1.0.0": {"b@v1.0.0"},
+				"b@v1.1.0": {"c@v1.0.0"},
+			},
+			mains:    []string{"a@v1.0.0"},
+			minimums: []string{"b@v1.1.0"},
+			want:     []string{"a@v1.0.0", "b@v1.1.0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The go version of each module comes along with its requirements.
+			module := func(s string) *Module {
+				mod := parseModule(s)
+				mod.goVersion = test.goVersions[s]
+				return mod
+			}
+			reqs := func(mod *Module) ([]*Module, error) {
+				required := []*Module{}
+				for _, req := range test.graph[mod.String()] {
+					required = append(required, module(req))
+				}
+				return required, nil
+			}
+			mains := []*Module{}
+			for _, main := range test.mains {
+				mains = append(mains, module(main))
+			}
+			minimums := []*Module{}
+			for _, min := range test.minimums {
+				minimums = append(minimums, module(min))
+			}
+
+			buildList, err := BuildList(mains, minimums, reqs)
+			if err != nil {
+				t.Fatalf("BuildList() failed: %v", err)
+			}
+			got := make([]string, 0, len(buildList))
+			for _, mod := range buildList {
+				got = append(got, mod.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("BuildList() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildListError(t *testing.T) {
+	errMissing := errors.New("missing go.mod")
+	reqs := func(mod *Module) ([]*Module, error) {
+		if mod.Path == "b" {
+			return nil, errMissing
+		}
+		return graph{"a@v1.0.0": {"b@v1.0.0"}}.reqs(mod)
+	}
+	_, err := BuildList([]*Module{parseModule("a@v1.0.0")}, nil, reqs)
+	if !errors.Is(err, errMissing) {
+		t.Errorf("BuildList() error = %v, want %v", err, errMissing)
+	}
+}
+
+func TestParseGoMod(t *testing.T) {
+	tests := []struct {
+		goMod  string
+		want   string
+		pruned bool
+	}{
+		{goMod: "module a\n", want: ""},
+		{goMod: "module a\n\ngo 1.16\n", want: "1.16"},
+		{goMod: "module a\n\ngo 1.17\n", want: "1.17", pruned: true},
+		{goMod: "module a\n\ngo 1.21.0\n\ntoolchain go1.21.5\n", want: "1.21.0", pruned: true},
+		{goMod: "module a\n\ngo 1.22rc1 // comment\n", want: "1.22rc1", pruned: true},
+		{goMod: "module a\ngo 2.0\nrequire b v1.0.0\n", want: "2.0", pruned: true},
+	}
+	for _, test := range tests {
+		goMod, goVersion, err := parseGoMod("go.mod", []byte(test.goMod), false)
+		if err != nil {
+			t.Errorf("parseGoMod(%q) failed: %v", test.goMod, err)
+			continue
+		}
+		if goMod.Module.Mod.Path != "a" {
+			t.Errorf("parseGoMod(%q) module = %q, want a", test.goMod, goMod.Module.Mod.Path)
+		}
+		if goVersion != test.want {
+			t.Errorf("parseGoMod(%q) go version = %q, want %q", test.goMod, goVersion, test.want)
+		}
+		if pruned := (&Module{goVersion: goVersion}).pruned(); pruned != test.pruned {
+			t.Errorf("go %s pruned = %v, want %v", goVersion, pruned, test.pruned)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package module
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// GetName returns a please friendly name for the module.
+func (m *Module) GetName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	_, name := m.layout.target(m.Path)
+	return name
+}
+
+// GetDownloadName returns a please friendly name for the module's go_mod_download rule.
+func (m *Module) GetDownloadName() string {
+	return m.GetName() + "_" + "download"
+}
+
+// GetBuildPath returns the path to the please BUILD file where this module is defined.
+func (m *Module) GetBuildPath() string {
+	return filepath.Join(filepath.FromSlash(m.buildPackage()), "BUILD")
+}
+
+// GetFullyQualifiedName returns the please build target for this module.
+func (m *Module) GetFullyQualifiedName() string {
+	return "//" + m.buildPackage() + ":" + m.GetName()
+}
+
+// GetFullyQualifiedDownloadName returns the please build target for this module's go_mod_download rule.
+func (m *Module) GetFullyQualifiedDownloadName() string {
+	return "//" + m.buildPackage() + ":" + m.GetDownloadName()
+}
+
+// buildPackage returns the please package of the BUILD file this module is defined in. This
+// is the one it was loaded from if it's already on disk, and otherwise the one the layout puts
+// it in. Both the BUILD path and the labels come from here, so they
+// always agree.
+func (m *Module) buildPackage() string {
+	dir := filepath.ToSlash(m.buildDir)
+	if dir == "" {
+		pkg, _ := m.layout.target(m.Path)
+		dir = path.Join(filepath.ToSlash(m.thirdParty), pkg)
+	}
+	if dir == "." {
+		return ""
+	}
+	return path.Clean(dir)
+}
+
+// SetName overrides the name of the rule for the module at path. This only applies to modules
+// that don't have a rule yet, as renaming an existing rule would break anything depending on it.
+func (d *Directory) SetName(path, name string) error {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		return fmt.Errorf("%q isn't a valid name for %s", name, path)
+	}
+	d.names[path] = name
+	return nil
+}
+
+// addRuleName records the names of the rules in a BUILD file on disk, along with the module
+// each of them is for, if any, so that new rules don't collide with them.
+func (d *Directory) addRuleName(pkg, name, modPath string) {
+	if d.ruleNames[pkg] == nil {
+		d.ruleNames[pkg] = map[string]string{}
+	}
+	d.ruleNames[pkg][name] = modPath
+}
+
+// assignNames picks the names of the rules of every module that doesn't have one yet, making
+// sure that none of them collide with each other, or with any other rule in the same package.
+// Modules already on disk keep the names they have, so labels never change once they have
+// been written, unless they are being moved somewhere the name is taken. If the name we would
+// normally pick is taken, a number is added to it.
+func (d *Directory) assignNames() error {
+	taken := map[string]map[string]string{}
+	for pkg, names := range d.ruleNames {
+		taken[pkg] = map[string]string{}
+		for name, modPath := range names {
+			taken[pkg][name] = modPath
+		}
+	}
+	// owner returns who has the name in the package, if anyone other than mod has it.
+	owner := func(mod *Module, pkg, name string) (string, bool) {
+		modPath, ok := taken[pkg][name]
+		if !ok || modPath == mod.Path || (modPath != "" && modPath == mod.GetDownloadPath()) {
+			return "", false
+		}
+		if modPath == "" {
+			return "a rule", true
+		}
+		return modPath, true
+	}
+	emitter := d.emitter()
+	// free returns who has either of the names the module would need, if anyone does.
+	free := func(mod *Module, pkg, name string) (string, bool) {
+		if other, ok := owner(mod, pkg, name); ok {
+			return other, false
+		}
+		if hasDownloadRule(emitter, mod) {
+			if other, ok := owner(mod, pkg, name+"_download"); ok {
+				return other, false
+			}
+		}
+		return "", true
+	}
+	claim := func(mod *Module, pkg string) {
+		if taken[pkg] == nil {
+			taken[pkg] = map[string]string{}
+		}
+		taken[pkg][mod.GetName()] = mod.Path
+		if hasDownloadRule(emitter, mod) {
+			taken[pkg][mod.GetDownloadName()] = mod.Path
+		}
+	}
+
+	// Claim the names of everything on disk first, so nothing new can take them.
+	mods := d.Modules()
+	for _, mod := range mods {
+		if mod.Name == "" {
+			continue
+		}
+		if name, ok := d.names[mod.Path]; ok && name != mod.Name {
+			return fmt.Errorf("%s is already defined by %s, so can't be named %s", mod.Path, mod.GetFullyQualifiedName(), name)
+		}
+		claim(mod, mod.buildPackage())
+	}
+
+	for _, mod := range mods {
+		if mod.Name != "" {
+			continue
+		}
+		pkg := mod.buildPackage()
+		if name, ok := d.names[mod.Path]; ok {
+			if other, ok := free(mod, pkg, name); !ok {
+				return fmt.Errorf("can't name %s %s, as %s already has that name in //%s", mod.Path, name, other, pkg)
+			}
+			mod.Name = name
+			claim(mod, pkg)
+			continue
+		}
+
+		// Moved rules keep their names if they can, so fewer labels change.
+		if old, ok := d.moved[mod.Path]; ok {
+			if _, ok := free(mod, pkg, old.names[0]); ok {
+				mod.Name = old.names[0]
+				claim(mod, pkg)
+				continue
+			}
+		}
+
+		_, name := mod.layout.target(mod.Path)
+		candidate := name
+		for i := 2; ; i++ {
+			other, ok := free(mod, pkg, candidate)
+			if ok {
+				break
+			}
+			log.Printf("%s is already used by %s in //%s, trying %s_%d for %s\n", candidate, other, pkg, name, i, mod.Path)
+			candidate = fmt.Sprintf("%s_%d", name, i)
+		}
+		mod.Name = candidate
+		claim(mod, pkg)
+	}
+	return nil
+}
+
+// hasDownloadRule returns whether the emitter gives the module a go_mod_download rule, which
+// needs a name of its own next to the module's.
+func hasDownloadRule(emitter Emitter, mod *Module) bool {
+	for _, rule := range emitter.Rules(mod) {
+		if rule.Kind() == "go_mod_download" {
+			return true
+		}
+	}
+	return false
+}
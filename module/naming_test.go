@@ -0,0 +1,49 @@
+package module
+
+import "testing"
+
+func TestAssignNamesReservesDownloadNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		emitter Emitter
+		want    string
+	}{
+		{name: "go_module", emitter: GoModuleEmitter{}, want: "foo"},
+		{name: "go_mod_download", emitter: GoModDownloadEmitter{}, want: "foo_2"},
+		{name: "go_repo", emitter: GoRepoEmitter{}, want: "foo"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDirectory("third_party/go", nil)
+			d.Emitter = test.emitter
+			mod := d.SetModule(parseModule("github.com/x/foo@v1.0.0"))
+			d.roots = append(d.roots, mod)
+			d.selectVersions([]*Module{mod})
+			// A hand written rule has the name foo's go_mod_download rule would get.
+			d.addRuleName(mod.buildPackage(), "foo_download", "")
+
+			if err := d.assignNames(); err != nil {
+				t.Fatalf("assignNames() failed: %v", err)
+			}
+			if mod.Name != test.want {
+				t.Errorf("named %s %q, want %q", mod.Path, mod.Name, test.want)
+			}
+		})
+	}
+}
+
+func TestAssignNamesReservesForkDownloadNames(t *testing.T) {
+	d := NewDirectory("third_party/go", nil)
+	mod := d.SetModule(parseModule("github.com/x/foo@v1.0.0"))
+	mod.replace = parseModule("github.com/fork/foo@v1.0.1")
+	d.roots = append(d.roots, mod)
+	d.selectVersions([]*Module{mod})
+	d.addRuleName(mod.buildPackage(), "foo_download", "")
+
+	if err := d.assignNames(); err != nil {
+		t.Fatalf("assignNames() failed: %v", err)
+	}
+	if mod.Name != "foo_2" {
+		t.Errorf("named the fork %q, want %q", mod.Name, "foo_2")
+	}
+}
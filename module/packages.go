@@ -0,0 +1,341 @@
+package module
+
+import (
+	"fmt"
+	"go/build"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Package is a single Go package within a module.
+type Package struct {
+	// Rel is the path of the package relative to the module root, or "" for the root package.
+	Rel     string
+	Name    string
+	Imports []string
+}
+
+// Platform is a GOOS and GOARCH that packages are built for.
+type Platform struct {
+	GOOS, GOARCH string
+}
+
+// DefaultPlatform is the platform packages are scanned for unless another one is asked for.
+var DefaultPlatform = Platform{GOOS: "linux", GOARCH: "amd64"}
+
+// ParsePlatform parses a platform in the os_arch form plz --arch takes, e.g. darwin_arm64.
+func ParsePlatform(s string) (Platform, error) {
+	i := strings.Index(s, "_")
+	if i <= 0 || i == len(s)-1 {
+		return Platform{}, fmt.Errorf("platform %q should be in os_arch form, e.g. linux_amd64", s)
+	}
+	return Platform{GOOS: s[:i], GOARCH: s[i+1:]}, nil
+}
+
+func (p Platform) String() string {
+	return p.GOOS + "_" + p.GOARCH
+}
+
+// scanPackages walks the downloaded module and returns the packages in it that would be
+// built for the platform, keyed by their path relative to the module root. The rules we
+// generate are shared by everyone building the repo, so build constraints are applied for the
+// platform we're told about rather than the one we happen to be running on, with cgo enabled.
+func scanPackages(dir string, platform Platform) (map[string]*Package, error) {
+	ctx := build.Default
+	ctx.GOOS, ctx.GOARCH, ctx.CgoEnabled = platform.GOOS, platform.GOARCH, true
+	pkgs := map[string]*Package{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if path != dir && (name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			return filepath.SkipDir
+		}
+		pkg, err := ctx.ImportDir(path, 0)
+		if _, ok := err.(*build.NoGoError); ok {
+			// Directories without any go files for the platform aren't packages.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		pkgs[rel] = &Package{
+			Rel:     rel,
+			Name:    pkg.Name,
+			Imports: pkg.Imports,
+		}
+		return nil
+	})
+	return pkgs, err
+}
+
+// installer works out which packages of each module are actually needed.
+type installer struct {
+	mods []*Module
+	pkgs map[*Module]map[string]*Package
+	// satisfiable caches whether every import of a package, and every import of those
+	// imports, can be found in the modules we have.
+	satisfiable map[string]bool
+	used        map[*Module]map[string]struct{}
+}
+
+// newInstaller scans the packages of each of the modules for the platform.
+func newInstaller(mods []*Module, platform Platform) (*installer, error) {
+	in := &installer{
+		mods:        mods,
+		pkgs:        map[*Module]map[string]*Package{},
+		satisfiable: map[string]bool{},
+		used:        map[*Module]map[string]struct{}{},
+	}
+	for _, mod := range in.mods {
+		pkgs, err := mod.packages(platform)
+		if err != nil {
+			return nil, err
+		}
+		if pkgs != nil {
+			in.pkgs[mod] = pkgs
+		}
+	}
+	return in, nil
+}
+
+// computeInstalls sets the install list of each module to the packages that are reachable
+// from the packages we want from the roots, which means we only ever compile what is actually
+// imported. The roots are what the repo asked for, and we can't know which of their packages
+// it is going to import, so we want every library package of theirs that can be built. Their
+// commands aren't installed, as they're rarely what's wanted, and a module config install
+// list can ask for them. This is worked out from scratch every time, so the lists follow
+// whatever the roots need now. Only install lists from the module config are left alone.
+// Modules we can't scan keep whatever install list they have on disk.
+func (d *Directory) computeInstalls() error {
+	for _, mod := range d.Modules() {
+		mod.Install = nil
+		if mod.config != nil && len(mod.config.Install) > 0 {
+			mod.Install = mod.config.Install
+		}
+	}
+	in, err := newInstaller(d.Modules(), d.Platform)
+	if err != nil {
+		return err
+	}
+
+	for _, mod := range d.selectedRoots() {
+		for _, rel := range in.wanted(mod) {
+			in.use(mod, rel)
+		}
+	}
+
+	// Go through the rest of the modules with dependants first, so that by the time we get
+	// to a module we know whether anything else we are installing imports it.
+	for _, mod := range dependantsFirst(in.mods) {
+		if _, ok := in.used[mod]; ok || len(mod.Install) > 0 {
+			continue
+		}
+		// Nothing we want imports this module, so install whatever we can.
+		for _, rel := range in.wanted(mod) {
+			in.use(mod, rel)
+		}
+	}
+
+	for _, mod := range in.mods {
+		if len(mod.Install) > 0 {
+			continue
+		}
+		if in.pkgs[mod] == nil {
+			mod.Install = mod.existingInstall
+			continue
+		}
+		install := make([]string, 0, len(in.used[mod]))
+		for rel := range in.used[mod] {
+			if rel == "" {
+				rel = "."
+			}
+			install = append(install, rel)
+		}
+		sort.Strings(install)
+		mod.Install = install
+	}
+	return nil
+}
+
+// candidates returns the packages we would like from a module we haven't been asked for
+// specific packages of. These are those matched by its install list, or otherwise every
+// importable package.
+func (in *installer) candidates(mod *Module) []string {
+	candidates := []string{}
+	for rel, pkg := range in.pkgs[mod] {
+		if len(mod.Install) > 0 {
+			if matchesInstall(mod.Install, rel) {
+				candidates = append(candidates, rel)
+			}
+			continue
+		}
+		if pkg.Name != "main" {
+			candidates = append(candidates, rel)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// wanted returns the candidate packages of the module that can actually be built.
+func (in *installer) wanted(mod *Module) []string {
+	if len(mod.Install) > 0 {
+		// We have been told exactly what to install, so we don't get to be picky.
+		return in.candidates(mod)
+	}
+	wanted := []string{}
+	for _, rel := range in.candidates(mod) {
+		if !in.isSatisfiable(mod, rel) {
+			log.Printf("Not installing %s as some of its imports can't be found\n", joinImportPath(mod.Path, rel))
+			continue
+		}
+		wanted = append(wanted, rel)
+	}
+	return wanted
+}
+
+// use marks the package as used, along with everything it imports.
+func (in *installer) use(mod *Module, rel string) {
+	if _, ok := in.used[mod][rel]; ok {
+		return
+	}
+	if in.used[mod] == nil {
+		in.used[mod] = map[string]struct{}{}
+	}
+	in.used[mod][rel] = struct{}{}
+
+	pkg := in.pkgs[mod][rel]
+	if pkg == nil {
+		return
+	}
+	for _, imp := range pkg.Imports {
+		if depMod, depRel, ok := in.resolve(imp); ok {
+			in.use(depMod, depRel)
+		}
+	}
+}
+
+// isSatisfiable returns whether all of the transitive imports of the package can be found.
+func (in *installer) isSatisfiable(mod *Module, rel string) bool {
+	importPath := joinImportPath(mod.Path, rel)
+	if ok, seen := in.satisfiable[importPath]; seen {
+		return ok
+	}
+	// Assume the best while we're working this out, in case of import cycles.
+	in.satisfiable[importPath] = true
+
+	ok := true
+	for _, imp := range in.pkgs[mod][rel].Imports {
+		if isStdLib(imp) {
+			continue
+		}
+		depMod, depRel, found := in.resolve(imp)
+		if !found || !in.isSatisfiable(depMod, depRel) {
+			ok = false
+			break
+		}
+	}
+	in.satisfiable[importPath] = ok
+	return ok
+}
+
+// resolve finds the module and package providing the import path.
+func (in *installer) resolve(importPath string) (*Module, string, bool) {
+	if isStdLib(importPath) {
+		return nil, "", false
+	}
+	var owner *Module
+	for _, mod := range in.mods {
+		if importPath != mod.Path && !strings.HasPrefix(importPath, mod.Path+"/") {
+			continue
+		}
+		if owner == nil || len(mod.Path) > len(owner.Path) {
+			owner = mod
+		}
+	}
+	if owner == nil {
+		return nil, "", false
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(importPath, owner.Path), "/")
+	if _, ok := in.pkgs[owner][rel]; !ok {
+		return nil, "", false
+	}
+	return owner, rel, true
+}
+
+// dependantsFirst orders the modules so that each module comes before its dependencies,
+// as far as is possible with cycles.
+func dependantsFirst(mods []*Module) []*Module {
+	order := make([]*Module, 0, len(mods))
+	visited := map[*Module]struct{}{}
+	var visit func(mod *Module)
+	visit = func(mod *Module) {
+		if _, ok := visited[mod]; ok {
+			return
+		}
+		visited[mod] = struct{}{}
+		for _, dep := range mod.Deps {
+			visit(dep)
+		}
+		order = append(order, mod)
+	}
+	for _, mod := range mods {
+		visit(mod)
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// matchesInstall returns whether the package matches any of the install patterns.
+func matchesInstall(install []string, rel string) bool {
+	for _, pattern := range install {
+		switch {
+		case pattern == "..." || pattern == "./...":
+			return true
+		case strings.HasSuffix(pattern, "/..."):
+			prefix := strings.TrimPrefix(strings.TrimSuffix(pattern, "/..."), "./")
+			if rel == prefix || strings.HasPrefix(rel, prefix+"/") {
+				return true
+			}
+		case pattern == "." || pattern == "":
+			if rel == "" {
+				return true
+			}
+		case strings.TrimPrefix(pattern, "./") == rel:
+			return true
+		}
+	}
+	return false
+}
+
+// isStdLib returns whether the import path is part of the standard library, which we
+// assume is anything without a dot in the first path element.
+func isStdLib(importPath string) bool {
+	first := strings.SplitN(importPath, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
+
+func joinImportPath(modPath, rel string) string {
+	if rel == "" {
+		return modPath
+	}
+	return modPath + "/" + rel
+}
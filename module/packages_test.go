@@ -0,0 +1,118 @@
+package module
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestScanPackages(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"go.mod":            "module example.com/m\n",
+		"lib.go":            "package m\n\nimport _ \"example.com/common\"\n",
+		"plat/a_linux.go":   "package plat\n\nimport _ \"example.com/linuxonly\"\n",
+		"plat/a_windows.go": "package plat\n\nimport _ \"example.com/windowsonly\"\n",
+		"winonly/w.go":      "//go:build windows\n// +build windows\n\npackage winonly\n",
+		"cgo/c.go":          "//go:build cgo\n// +build cgo\n\npackage cgo\n",
+		"gen/gen.go":        "//go:build ignore\n// +build ignore\n\npackage main\n",
+		"gen/lib.go":        "package gen\n",
+		"docs/README.md":    "No go files here\n",
+		"testdata/x.go":     "package broken!\n",
+	})
+
+	tests := []struct {
+		platform    Platform
+		want        []string
+		platImports []string
+	}{
+		{
+			platform:    Platform{GOOS: "linux", GOARCH: "amd64"},
+			want:        []string{"", "cgo", "gen", "plat"},
+			platImports: []string{"example.com/linuxonly"},
+		},
+		{
+			platform:    Platform{GOOS: "windows", GOARCH: "amd64"},
+			want:        []string{"", "cgo", "gen", "plat", "winonly"},
+			platImports: []string{"example.com/windowsonly"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.platform.String(), func(t *testing.T) {
+			// Whatever platform the test runs on, we only get what builds on the one asked for.
+			pkgs, err := scanPackages(dir, test.platform)
+			if err != nil {
+				t.Fatalf("scanPackages() failed: %v", err)
+			}
+			got := []string{}
+			for rel := range pkgs {
+				got = append(got, rel)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("scanPackages() found %q, want %q", got, test.want)
+			}
+			if got := pkgs["plat"].Imports; !reflect.DeepEqual(got, test.platImports) {
+				t.Errorf("plat imports %v, want %v", got, test.platImports)
+			}
+			if got := pkgs["gen"].Name; got != "gen" {
+				t.Errorf("gen package name = %q, want gen", got)
+			}
+		})
+	}
+}
+
+func TestScanPackagesError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a/a.go": "package a\n",
+		"a/b.go": "package b\n",
+	})
+	if _, err := scanPackages(dir, DefaultPlatform); err == nil {
+		t.Errorf("scanPackages() of a directory with two packages in succeeded, want an error")
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	platform, err := ParsePlatform("darwin_arm64")
+	if err != nil {
+		t.Fatalf("ParsePlatform() failed: %v", err)
+	}
+	if want := (Platform{GOOS: "darwin", GOARCH: "arm64"}); platform != want {
+		t.Errorf("ParsePlatform() = %v, want %v", platform, want)
+	}
+	for _, s := range []string{"", "linux", "linux_", "_amd64"} {
+		if _, err := ParsePlatform(s); err == nil {
+			t.Errorf("ParsePlatform(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestComputeInstalls(t *testing.T) {
+	d := NewDirectory("third_party/go", nil)
+	root := d.SetModule(parseModule("example.com/root@v1.0.0"))
+	root.dir = writeFiles(t, map[string]string{
+		"lib.go":           "package root\n\nimport _ \"example.com/dep/x\"\n",
+		"sub/sub.go":       "package sub\n",
+		"cmd/tool/main.go": "package main\n\nimport _ \"example.com/dep/y\"\n",
+		"broken/broken.go": "package broken\n\nimport _ \"example.com/missing\"\n",
+	})
+	root.requires = []Requirement{{Path: "example.com/dep", Version: "v1.0.0"}}
+	dep := d.SetModule(parseModule("example.com/dep@v1.0.0"))
+	dep.dir = writeFiles(t, map[string]string{
+		"x/x.go": "package x\n",
+		"y/y.go": "package y\n",
+		"z/z.go": "package z\n\nimport _ \"example.com/dep/x\"\n",
+	})
+	d.roots = append(d.roots, root)
+	d.selectVersions([]*Module{root, dep})
+
+	if err := d.computeInstalls(); err != nil {
+		t.Fatalf("computeInstalls() failed: %v", err)
+	}
+	// The root gets every library package that builds, and the dep only what those import.
+	if want := []string{".", "sub"}; !reflect.DeepEqual(root.Install, want) {
+		t.Errorf("root installs %v, want %v", root.Install, want)
+	}
+	if want := []string{"x"}; !reflect.DeepEqual(dep.Install, want) {
+		t.Errorf("dep installs %v, want %v", dep.Install, want)
+	}
+}
@@ -0,0 +1,241 @@
+package module
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jamesjarvis/go-deps/buildfile"
+)
+
+// existingModules returns the modules loaded from the BUILD files on disk, keyed by the label
+// they have on disk.
+func (d *Directory) existingModules() map[string]*Module {
+	mods := map[string]*Module{}
+	for path, vd := range d.modules {
+		if mod := vd.existing(); mod != nil {
+			if moved, ok := d.moved[path]; ok {
+				mods[moved.label] = mod
+				continue
+			}
+			mods[mod.GetFullyQualifiedName()] = mod
+		}
+	}
+	return mods
+}
+
+// dependents returns the reverse of the deps of the rules on disk, i.e. the modules that
+// depend on each module. Deps on anything other than the given modules are ignored.
+func dependents(existing map[string]*Module) map[*Module][]*Module {
+	reverse := map[*Module][]*Module{}
+	for _, label := range sortedLabels(existing) {
+		mod := existing[label]
+		for _, dep := range mod.existingDeps {
+			if depMod, ok := existing[dep]; ok && depMod != mod {
+				reverse[depMod] = append(reverse[depMod], mod)
+			}
+		}
+	}
+	return reverse
+}
+
+// Roots returns the modules everything else is needed for, sorted by module path. These are
+// the modules we have been asked to resolve, the roots in the lock file, and the modules on
+// disk that nothing else on disk depends on, which must be used directly by the rest of the
+// repo.
+func (d *Directory) Roots() []*Module {
+	existing := d.existingModules()
+	reverse := dependents(existing)
+
+	roots := map[*Module]struct{}{}
+	for _, root := range d.roots {
+		roots[root] = struct{}{}
+	}
+	for _, mod := range existing {
+		if _, ok := d.removed[mod.Path]; ok {
+			continue
+		}
+		if _, ok := d.lockedRoots[mod.Path]; ok || len(reverse[mod]) == 0 {
+			roots[mod] = struct{}{}
+		}
+	}
+	// Modules that depend on each other can be unreachable from any module nothing depends
+	// on, so pick a root out of any cycles like that too.
+	reachable := reachableFrom(existing, roots)
+	for _, label := range sortedLabels(existing) {
+		mod := existing[label]
+		if _, ok := reachable[mod]; ok {
+			continue
+		}
+		if _, ok := d.removed[mod.Path]; ok {
+			continue
+		}
+		roots[mod] = struct{}{}
+		for reached := range reachableFrom(existing, map[*Module]struct{}{mod: {}}) {
+			reachable[reached] = struct{}{}
+		}
+	}
+
+	sorted := make([]*Module, 0, len(roots))
+	for root := range roots {
+		sorted = append(sorted, root)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
+
+// reachableFrom returns the modules on disk that can be reached from the roots through the
+// deps of their rules, including the roots themselves.
+func reachableFrom(existing map[string]*Module, roots map[*Module]struct{}) map[*Module]struct{} {
+	reachable := map[*Module]struct{}{}
+	queue := make([]*Module, 0, len(roots))
+	for root := range roots {
+		queue = append(queue, root)
+	}
+	for len(queue) > 0 {
+		mod := queue[0]
+		queue = queue[1:]
+		if _, ok := reachable[mod]; ok {
+			continue
+		}
+		reachable[mod] = struct{}{}
+		for _, dep := range mod.existingDeps {
+			if depMod, ok := existing[dep]; ok {
+				queue = append(queue, depMod)
+			}
+		}
+	}
+	return reachable
+}
+
+// Remove removes the modules with the given paths from the third party directory, along
+// with any of their dependencies that are no longer needed by any of the remaining roots.
+// Modules that are still depended on by other modules, or used by any other rule in the repo,
+// can't be removed, and dependencies that are used by the rest of the repo are kept. The removed modules
+// are returned sorted by path, and their rules are deleted when the directory is written out.
+func (d *Directory) Remove(paths ...string) ([]*Module, error) {
+	existing := d.existingModules()
+	byPath := map[string]*Module{}
+	for _, mod := range existing {
+		byPath[mod.Path] = mod
+	}
+
+	removing := map[*Module]struct{}{}
+	for _, path := range paths {
+		mod, ok := byPath[path]
+		if !ok {
+			return nil, fmt.Errorf("%s isn't in the third party directory", path)
+		}
+		removing[mod] = struct{}{}
+	}
+	reverse := dependents(existing)
+	for mod := range removing {
+		needed := []string{}
+		for _, dependent := range reverse[mod] {
+			if _, ok := removing[dependent]; !ok {
+				needed = append(needed, dependent.String())
+			}
+		}
+		if len(needed) > 0 {
+			sort.Strings(needed)
+			return nil, fmt.Errorf("can't remove %s as it is still needed by %s", mod.String(), strings.Join(needed, ", "))
+		}
+	}
+
+	// Anything the rest of the repo uses has to stay, however little else in here needs it.
+	refs, err := externalReferences(existing)
+	if err != nil {
+		return nil, err
+	}
+	for mod := range removing {
+		if len(refs[mod]) > 0 {
+			return nil, fmt.Errorf("can't remove %s as it is still used by %s", mod.String(), strings.Join(refs[mod], ", "))
+		}
+	}
+
+	roots := map[*Module]struct{}{}
+	for _, root := range d.Roots() {
+		if _, ok := removing[root]; !ok {
+			roots[root] = struct{}{}
+		}
+	}
+	reachable := reachableFrom(existing, roots)
+	for _, label := range sortedLabels(existing) {
+		mod := existing[label]
+		if _, ok := reachable[mod]; ok || len(refs[mod]) == 0 {
+			continue
+		}
+		log.Printf("Keeping %s as it is used by %s\n", mod.String(), strings.Join(refs[mod], ", "))
+		for kept := range reachableFrom(existing, map[*Module]struct{}{mod: {}}) {
+			reachable[kept] = struct{}{}
+		}
+	}
+
+	removed := []*Module{}
+	for _, mod := range existing {
+		if _, ok := reachable[mod]; !ok {
+			d.removed[mod.Path] = mod
+			removed = append(removed, mod)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].Path < removed[j].Path
+	})
+	return removed, nil
+}
+
+// externalReferences returns the labels of the rules in the repo that use each of the modules
+// on disk, other than the rules of the modules themselves, sorted. The repo is assumed to be the
+// working directory.
+func externalReferences(existing map[string]*Module) (map[*Module][]string, error) {
+	byLabel := map[string]*Module{}
+	for label, mod := range existing {
+		byLabel[label] = mod
+		byLabel[label[:strings.LastIndex(label, ":")+1]+mod.GetDownloadName()] = mod
+	}
+
+	refs := map[*Module][]string{}
+	err := buildfile.Walk(".", func(buildPath string) error {
+		file, err := buildfile.ParseFile(buildPath)
+		if err != nil {
+			return err
+		}
+		pkg := filepath.ToSlash(filepath.Dir(buildPath))
+		if pkg == "." {
+			pkg = ""
+		}
+		for _, rule := range file.Rules() {
+			label := "//" + pkg + ":" + rule.Name()
+			if _, ok := byLabel[label]; ok || rule.Name() == "" {
+				continue
+			}
+			for _, value := range rule.Strings() {
+				if mod, ok := byLabel[canonicalLabel(value, pkg)]; ok {
+					refs[mod] = append(refs[mod], label)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the rules using third party modules: %w", err)
+	}
+	for mod, labels := range refs {
+		refs[mod] = dedupe(labels)
+	}
+	return refs, nil
+}
+
+// sortedLabels returns the labels of the modules in order, so we walk them deterministically.
+func sortedLabels(mods map[string]*Module) []string {
+	labels := make([]string, 0, len(mods))
+	for label := range mods {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
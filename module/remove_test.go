@@ -0,0 +1,80 @@
+package module
+
+import (
+	"strings"
+	"testing"
+)
+
+// removeRepo has foo depending on bar, which depends on baz.
+var removeRepo = map[string]string{
+	"third_party/go/example.com/BUILD": moduleRule("foo", "example.com/foo", "v1.0.0", ":bar") + "\n" +
+		moduleRule("bar", "example.com/bar", "v1.0.0", ":baz") + "\n" +
+		moduleRule("baz", "example.com/baz", "v1.0.0"),
+}
+
+// removedPaths returns the paths of the removed modules.
+func removedPaths(removed []*Module) string {
+	paths := []string{}
+	for _, mod := range removed {
+		paths = append(paths, mod.Path)
+	}
+	return strings.Join(paths, " ")
+}
+
+func TestRemove(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), removeRepo)
+
+	removed, err := d.Remove("example.com/foo")
+	if err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if got, want := removedPaths(removed), "example.com/bar example.com/baz example.com/foo"; got != want {
+		t.Errorf("Remove() removed %s, want %s", got, want)
+	}
+}
+
+func TestRemoveKeepsModulesUsedByTheRepo(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), withFiles(removeRepo, map[string]string{
+		"app/BUILD": "go_library(\n    name = \"app\",\n    deps = [\"//third_party/go/example.com:baz\"],\n)\n",
+	}))
+
+	removed, err := d.Remove("example.com/foo")
+	if err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if got, want := removedPaths(removed), "example.com/bar example.com/foo"; got != want {
+		t.Errorf("Remove() removed %s, want %s", got, want)
+	}
+}
+
+func TestRemoveStillNeeded(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), removeRepo)
+
+	_, err := d.Remove("example.com/bar")
+	if err == nil || !strings.Contains(err.Error(), "still needed by example.com/foo@v1.0.0") {
+		t.Errorf("Remove() error = %v, want bar to still be needed by foo", err)
+	}
+	if len(d.removed) != 0 {
+		t.Errorf("Remove() marked %d modules as removed, want none", len(d.removed))
+	}
+}
+
+func TestRemoveStillReferenced(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), withFiles(removeRepo, map[string]string{
+		"app/BUILD": "go_library(\n    name = \"app\",\n    deps = [\"//third_party/go/example.com:foo\"],\n)\n",
+	}))
+
+	_, err := d.Remove("example.com/foo")
+	if err == nil || !strings.Contains(err.Error(), "still used by //app:app") {
+		t.Errorf("Remove() error = %v, want foo to still be used by //app:app", err)
+	}
+}
+
+func TestRemoveNotInThirdParty(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), removeRepo)
+
+	_, err := d.Remove("example.com/missing")
+	if err == nil || !strings.Contains(err.Error(), "isn't in the third party directory") {
+		t.Errorf("Remove() error = %v, want example.com/missing to be missing", err)
+	}
+}
@@ -0,0 +1,197 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// Replacement is a replace directive from the main module's go.mod.
+type Replacement struct {
+	OldPath, OldVersion string
+	NewPath, NewVersion string
+}
+
+// String returns the replacement in the same form as the go.mod directive.
+func (r Replacement) String() string {
+	old := r.OldPath
+	if r.OldVersion != "" {
+		old += " " + r.OldVersion
+	}
+	replacement := r.NewPath
+	if r.NewVersion != "" {
+		replacement += " " + r.NewVersion
+	}
+	return old + " => " + replacement
+}
+
+// IsLocal returns whether the module is replaced by a directory on the filesystem.
+func (r Replacement) IsLocal() bool {
+	return r.NewVersion == ""
+}
+
+// AddMainModuleDirectives applies the replace and exclude directives of the module's go.mod
+// to the rest of the resolution, as if it were the main module.
+func (d *Directory) AddMainModuleDirectives(mod *Module) error {
+	goMod, _, err := mod.readGoMod(false)
+	if err != nil {
+		return err
+	}
+	return d.addDirectives(goMod)
+}
+
+// AddGoMod reads the go.mod file at path as the main module, applying its replace and
+// exclude directives and checking downloads against its go.sum, and returns its requirements
+// as the modules to resolve. The modules it returns are then treated as requirements of the
+// main module, rather than main modules themselves, so its go version decides how the module
+// graph is pruned.
+func (d *Directory) AddGoMod(path string) ([]*Module, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read go.mod file: %w", err)
+	}
+	goMod, goVersion, err := parseGoMod(path, data, false)
+	if err != nil {
+		return nil, err
+	}
+	err = d.addDirectives(goMod)
+	if err != nil {
+		return nil, err
+	}
+	d.mainModule = &Module{goVersion: goVersion}
+	if goMod.Module != nil {
+		d.mainModule.Path = goMod.Module.Mod.Path
+	}
+
+	// Check everything against the go.sum alongside it, if there is one.
+	goSum := filepath.Join(filepath.Dir(path), "go.sum")
+	if _, err := os.Stat(goSum); err == nil {
+		err = d.AddGoSum(goSum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	roots := make([]*Module, 0, len(goMod.Require))
+	for _, req := range goMod.Require {
+		if d.inRepo(req.Mod.Path) {
+			log.Printf("Skipping %s as it is part of this repo\n", req.Mod.String())
+			continue
+		}
+		roots = append(roots, &Module{
+			Path:    req.Mod.Path,
+			Version: req.Mod.Version,
+		})
+	}
+	return roots, nil
+}
+
+// addDirectives adds the replace and exclude directives from the go.mod file.
+func (d *Directory) addDirectives(goMod *modfile.File) error {
+	for _, rep := range goMod.Replace {
+		replacement := Replacement{
+			OldPath:    rep.Old.Path,
+			OldVersion: rep.Old.Version,
+			NewPath:    rep.New.Path,
+			NewVersion: rep.New.Version,
+		}
+		key := replacementKey(replacement.OldPath, replacement.OldVersion)
+		if existing, ok := d.replacements[key]; ok && existing != replacement {
+			return fmt.Errorf("conflicting replacements for %s: %s and %s", key, existing, replacement)
+		}
+		d.replacements[key] = replacement
+	}
+	for _, exclude := range goMod.Exclude {
+		d.excluded[exclude.Mod.String()] = struct{}{}
+	}
+	return nil
+}
+
+// replacement returns the replace directive that applies to the module, if any. A directive
+// for a specific version takes precedence over one for every version of the module, and the
+// directives of the main module take precedence over the ones the modules on disk were
+// written with.
+func (d *Directory) replacement(mod *Module) (Replacement, bool) {
+	if rep, ok := d.replacements[replacementKey(mod.Path, mod.Version)]; ok {
+		return rep, true
+	}
+	if rep, ok := d.replacements[replacementKey(mod.Path, "")]; ok {
+		return rep, true
+	}
+	rep, ok := d.lockedReplacements[mod.Path]
+	return rep, ok
+}
+
+// applyReplacement points the module at its replacement, if it has one.
+func (d *Directory) applyReplacement(mod *Module) error {
+	rep, ok := d.replacement(mod)
+	if !ok || mod.replace != nil {
+		return nil
+	}
+	for _, root := range d.roots {
+		if root == mod && d.mainModule == nil {
+			// Replacements never apply to the main module itself.
+			return nil
+		}
+	}
+	if rep.IsLocal() {
+		return fmt.Errorf("%s is replaced by the local directory %s, which can't be fetched by a go_module rule. Please add a rule for it by hand, or remove the replace directive", mod.String(), rep.NewPath)
+	}
+	log.Printf("Replacing %s with %s@%s\n", mod.String(), rep.NewPath, rep.NewVersion)
+	mod.replace = &Module{
+		Path:    rep.NewPath,
+		Version: rep.NewVersion,
+	}
+	return nil
+}
+
+// isExcluded returns whether the version of the module has been excluded.
+func (d *Directory) isExcluded(path, version string) bool {
+	_, ok := d.excluded[path+"@"+version]
+	return ok
+}
+
+// skipExcluded replaces any requirements on excluded versions with the next version of
+// the module that isn't excluded, which is what the go tool does too.
+func (d *Directory) skipExcluded(ctx context.Context, mod *Module) error {
+	for i, req := range mod.requires {
+		if !d.isExcluded(req.Path, req.Version) {
+			continue
+		}
+		next, err := d.nextAllowedVersion(ctx, req.Path, req.Version)
+		if err != nil {
+			return fmt.Errorf("%s requires %s, which is excluded: %w", mod.String(), req.String(), err)
+		}
+		log.Printf("%s requires %s, which is excluded, using %s instead\n", mod.String(), req.String(), next)
+		mod.requires[i].Version = next
+	}
+	return nil
+}
+
+// nextAllowedVersion returns the lowest version of the module above the given version
+// which hasn't been excluded.
+func (d *Directory) nextAllowedVersion(ctx context.Context, path, version string) (string, error) {
+	versions, err := d.fetcher.List(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range versions {
+		if semver.Compare(v, version) > 0 && !d.isExcluded(path, v) {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("no later version of %s is available", path)
+}
+
+func replacementKey(path, version string) string {
+	if version == "" {
+		return path
+	}
+	return path + "@" + version
+}
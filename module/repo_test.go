@@ -0,0 +1,150 @@
+package module
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles writes the files, keyed by their slash separated paths, to a temporary directory
+// and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// withFiles returns the files of the repo with some more added.
+func withFiles(repo map[string]string, files map[string]string) map[string]string {
+	all := map[string]string{}
+	for name, content := range repo {
+		all[name] = content
+	}
+	for name, content := range files {
+		all[name] = content
+	}
+	return all
+}
+
+// inRepo writes the files to a temporary repo, and runs the rest of the test in it, as the
+// commands run from the repo root.
+func inRepo(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := writeFiles(t, files)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// loadRepo writes the files to a temporary repo as with inRepo, and loads its third_party/go
+// directory the same way the commands do, fetching modules with the fetcher. Any configure
+// funcs are run on the directory first, as the flags are.
+func loadRepo(t *testing.T, fetcher Fetcher, files map[string]string, configure ...func(d *Directory)) *Directory {
+	t.Helper()
+	inRepo(t, files)
+	r := NewResolver("third_party/go", fetcher, FileWriter{})
+	for _, fn := range configure {
+		fn(r.Directory())
+	}
+	if err := r.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() failed: %v", err)
+	}
+	if err := r.LoadLock(false); err != nil {
+		t.Fatalf("LoadLock() failed: %v", err)
+	}
+	if err := r.Load(); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	return r.Directory()
+}
+
+// selectExisting selects the versions of the modules on disk, as if they had been resolved
+// without anything changing, so their requirements are just the deps of their rules.
+func selectExisting(d *Directory) {
+	existing := d.existingModules()
+	buildList := []*Module{}
+	for _, label := range sortedLabels(existing) {
+		mod := existing[label]
+		mod.requires = []Requirement{}
+		for _, dep := range mod.existingDeps {
+			if depMod, ok := existing[dep]; ok {
+				mod.requires = append(mod.requires, Requirement{Path: depMod.Path, Version: depMod.Version})
+			}
+		}
+		buildList = append(buildList, mod)
+	}
+	d.selectVersions(buildList)
+	d.resolved = true
+}
+
+// readFile returns the contents of the file at path, relative to the repo.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.FromSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// moduleRule returns a go_module rule for a BUILD file.
+func moduleRule(name, path, version string, deps ...string) string {
+	rule := "go_module(\n    name = \"" + name + "\",\n    module = \"" + path + "\",\n    version = \"" + version + "\",\n"
+	if len(deps) > 0 {
+		rule += "    deps = [\n"
+		for _, dep := range deps {
+			rule += "        \"" + dep + "\",\n"
+		}
+		rule += "    ],\n"
+	}
+	return rule + "    visibility = [\"PUBLIC\"],\n)\n"
+}
+
+// resolveGraph returns a third party directory resolved from the roots, with the modules and
+// their requirements taken from the graph.
+func resolveGraph(t *testing.T, g graph, roots ...string) *Directory {
+	t.Helper()
+	d := NewDirectory("third_party/go", nil)
+	reqs := func(mod *Module) ([]*Module, error) {
+		mod = d.SetModule(mod)
+		required, err := g.reqs(mod)
+		if err != nil {
+			return nil, err
+		}
+		mod.requires = []Requirement{}
+		for i, req := range required {
+			required[i] = d.SetModule(req)
+			mod.requires = append(mod.requires, Requirement{Path: req.Path, Version: req.Version})
+		}
+		return required, nil
+	}
+	for _, root := range roots {
+		d.roots = append(d.roots, d.SetModule(parseModule(root)))
+	}
+	buildList, err := BuildList(d.roots, nil, reqs)
+	if err != nil {
+		t.Fatalf("BuildList() failed: %v", err)
+	}
+	d.selectVersions(buildList)
+	d.resolved = true
+	return d
+}
@@ -0,0 +1,161 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jamesjarvis/go-deps/host"
+)
+
+// Fetcher fetches modules from wherever they are hosted. *host.Proxy is the Fetcher
+// used by the command line tool.
+type Fetcher interface {
+	// Download downloads and extracts the version of the module matching the query.
+	Download(ctx context.Context, path, query string) (*host.GoModDownloadResponse, error)
+	// DownloadGoMod downloads just the go.mod file of the version of the module matching
+	// the query.
+	DownloadGoMod(ctx context.Context, path, query string) (*host.GoModDownloadResponse, error)
+	// List returns the known versions of the module, in semver order.
+	List(ctx context.Context, path string) ([]string, error)
+}
+
+// Writer writes out the generated BUILD files.
+type Writer interface {
+	WriteFile(path string, data []byte) error
+	// RemoveFile removes a BUILD file that no longer has anything in it.
+	RemoveFile(path string) error
+}
+
+// FileWriter is a Writer that writes files to disk, creating any directories they need.
+type FileWriter struct{}
+
+// WriteFile writes the data to the file at path.
+func (FileWriter) WriteFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700) // Create the nested directory
+	if err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write build file: %w", err)
+	}
+	return nil
+}
+
+// RemoveFile removes the file at path.
+func (FileWriter) RemoveFile(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove build file: %w", err)
+	}
+	return nil
+}
+
+// Resolver adds modules to a third party directory. It loads the rules already in there,
+// resolves the new modules along with them, and writes out the rules that have changed.
+type Resolver struct {
+	dir        *Directory
+	writer     Writer
+	thirdParty string
+}
+
+// NewResolver returns a Resolver for the third party directory, which fetches modules with
+// the fetcher and writes BUILD files with the writer.
+func NewResolver(thirdParty string, fetcher Fetcher, writer Writer) *Resolver {
+	return &Resolver{
+		dir:        NewDirectory(thirdParty, fetcher),
+		writer:     writer,
+		thirdParty: thirdParty,
+	}
+}
+
+// Directory returns the directory of modules the resolver is working with.
+func (r *Resolver) Directory() *Directory {
+	return r.dir
+}
+
+// Load loads the modules already defined in the third party directory.
+func (r *Resolver) Load() error {
+	return r.dir.LoadBuildRules()
+}
+
+// LoadConfig loads the module config file in the third party directory, if there is one. It
+// should be loaded before anything else, so it applies to every module.
+func (r *Resolver) LoadConfig() error {
+	return r.dir.LoadConfig(filepath.Join(r.thirdParty, ConfigFileName))
+}
+
+// LoadLock loads the lock file in the third party directory, if there is one. When updating,
+// the locked versions are ignored, so everything is resolved from scratch. It should be loaded
+// before the third party directory, so that forks are loaded at the right version.
+func (r *Resolver) LoadLock(update bool) error {
+	return r.dir.LoadLock(filepath.Join(r.thirdParty, LockFileName), update)
+}
+
+// LoadGoMod reads the go.mod file at path as the main module, returning its requirements as
+// the modules to resolve, and applying its replace and exclude directives.
+func (r *Resolver) LoadGoMod(path string) ([]*Module, error) {
+	return r.dir.AddGoMod(path)
+}
+
+// LoadGoSum adds the hashes from the go.sum file at path, which downloads are checked against.
+func (r *Resolver) LoadGoSum(path string) error {
+	return r.dir.AddGoSum(path)
+}
+
+// Resolve works out the versions of the root modules and all of their dependencies.
+func (r *Resolver) Resolve(ctx context.Context, roots ...*Module) error {
+	return r.dir.Resolve(ctx, roots...)
+}
+
+// Upgrade raises the minimum versions of the modules already in the third party directory,
+// ready for them to be resolved again. See Directory.Upgrade.
+func (r *Resolver) Upgrade(ctx context.Context, policy UpgradePolicy, paths ...string) error {
+	return r.dir.Upgrade(ctx, policy, paths...)
+}
+
+// Remove removes the modules from the third party directory, along with any dependencies
+// that are no longer needed, returning everything that will be removed. See Directory.Remove.
+func (r *Resolver) Remove(paths ...string) ([]*Module, error) {
+	return r.dir.Remove(paths...)
+}
+
+// Move moves the rules in the third party directory that aren't where the directory's layout
+// would put them, returning the modules that will be moved. See Directory.Move.
+func (r *Resolver) Move() []*Module {
+	return r.dir.Move()
+}
+
+// Write writes out the modules that have been added or changed, and the lock file.
+func (r *Resolver) Write() error {
+	err := r.dir.ExportBuildRules(r.writer)
+	if err != nil {
+		return err
+	}
+	return r.dir.WriteLock(r.writer)
+}
+
+// Add is a shortcut for loading the third party directory along with its module config and
+// lock file, resolving the roots and writing the results.
+func (r *Resolver) Add(ctx context.Context, roots ...*Module) error {
+	err := r.LoadConfig()
+	if err != nil {
+		return err
+	}
+	err = r.LoadLock(false)
+	if err != nil {
+		return err
+	}
+	err = r.Load()
+	if err != nil {
+		return err
+	}
+	err = r.Resolve(ctx, roots...)
+	if err != nil {
+		return err
+	}
+	return r.Write()
+}
@@ -0,0 +1,180 @@
+package module
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// The names of the emitters, as given to ParseEmitter.
+const (
+	EmitGoModule      = "go_module"
+	EmitGoModDownload = "go_mod_download"
+	EmitGoRepo        = "go_repo"
+)
+
+// moduleRuleKinds are the kinds of rules we generate for modules.
+var moduleRuleKinds = []string{"go_module", "go_mod_download", "go_repo"}
+
+// Emitter produces the rules for a module. Different versions of Please want different rules,
+// so the emitter can be picked to suit the repo.
+type Emitter interface {
+	// Rules returns the rules for the module, in the order they go in the BUILD file. The rule
+	// named after the module must be the one other rules depend on, and any download rule must
+	// be named after its download name.
+	Rules(mod *Module) []*build.Rule
+}
+
+// ParseEmitter returns the emitter with the given name.
+func ParseEmitter(name string) (Emitter, error) {
+	switch name {
+	case EmitGoModule:
+		return GoModuleEmitter{}, nil
+	case EmitGoModDownload:
+		return GoModDownloadEmitter{}, nil
+	case EmitGoRepo:
+		return GoRepoEmitter{}, nil
+	}
+	return nil, fmt.Errorf("unknown rules %q, expected one of %s, %s or %s", name, EmitGoModule, EmitGoModDownload, EmitGoRepo)
+}
+
+// GoModuleEmitter emits a go_module rule for each module. Forks get a go_mod_download rule
+// too, as go_module uses the module path as the import path. This is the default.
+type GoModuleEmitter struct{}
+
+// Rules returns the go_module rule for the module, and its go_mod_download rule if it's a fork.
+func (GoModuleEmitter) Rules(mod *Module) []*build.Rule {
+	if mod.GetDownloadPath() == mod.Path {
+		rule := newRule("go_module", mod.GetName())
+		setString(rule, "module", mod.Path)
+		setString(rule, "version", mod.GetDownloadVersion())
+		setStrings(rule, "deps", mod.ruleDeps())
+		setStrings(rule, "labels", mod.GetSumLabels())
+		setStrings(rule, "visibility", mod.GetVisibility())
+		setStrings(rule, "install", mod.GetInstall())
+		setDownloadConfig(rule, mod)
+		return []*build.Rule{rule}
+	}
+	return GoModDownloadEmitter{}.Rules(mod)
+}
+
+// GoModDownloadEmitter emits a go_mod_download rule for every module, along with a go_module
+// rule that builds it, so the download can be shared with other rules.
+type GoModDownloadEmitter struct{}
+
+// Rules returns the go_mod_download and go_module rules for the module.
+func (GoModDownloadEmitter) Rules(mod *Module) []*build.Rule {
+	rule := newRule("go_module", mod.GetName())
+	setString(rule, "module", mod.Path)
+	setString(rule, "download", mod.GetFullyQualifiedDownloadName())
+	setStrings(rule, "deps", mod.ruleDeps())
+	setStrings(rule, "visibility", mod.GetVisibility())
+	setStrings(rule, "install", mod.GetInstall())
+	return []*build.Rule{downloadRule(mod), rule}
+}
+
+// GoRepoEmitter emits go_repo rules, which Please builds as subrepos using the module's own
+// go.mod, so they don't need deps. The modules they need are listed as requirements, which
+// covers modules that don't have a go.mod too. Forks get a go_mod_download rule.
+type GoRepoEmitter struct{}
+
+// Rules returns the go_repo rule for the module, and its go_mod_download rule if it's a fork.
+func (GoRepoEmitter) Rules(mod *Module) []*build.Rule {
+	rule := newRule("go_repo", mod.GetName())
+	setString(rule, "module", mod.Path)
+	setStrings(rule, "install", mod.Install)
+	setStrings(rule, "requirements", mod.depPaths())
+	setStrings(rule, "visibility", mod.GetVisibility())
+	if mod.GetDownloadPath() == mod.Path {
+		setString(rule, "version", mod.GetDownloadVersion())
+		setStrings(rule, "labels", mod.GetSumLabels())
+		setDownloadConfig(rule, mod)
+		return []*build.Rule{rule}
+	}
+	setString(rule, "download", mod.GetFullyQualifiedDownloadName())
+	return []*build.Rule{downloadRule(mod), rule}
+}
+
+// downloadRule returns the go_mod_download rule for the module, which records its hashes.
+func downloadRule(mod *Module) *build.Rule {
+	rule := newRule("go_mod_download", mod.GetDownloadName())
+	setString(rule, "module", mod.GetDownloadPath())
+	setString(rule, "version", mod.GetDownloadVersion())
+	setStrings(rule, "labels", mod.GetSumLabels())
+	setStrings(rule, "visibility", mod.GetVisibility())
+	setDownloadConfig(rule, mod)
+	return rule
+}
+
+// isModuleRule returns whether the rule is one of the kinds we generate for modules.
+func isModuleRule(kind string) bool {
+	for _, k := range moduleRuleKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// depPaths returns the sorted module paths of the module's deps, without any duplicates.
+func (m *Module) depPaths() []string {
+	paths := make([]string, 0, len(m.Deps))
+	for _, dep := range m.Deps {
+		paths = append(paths, dep.Path)
+	}
+	return dedupe(paths)
+}
+
+// depLabels returns the sorted labels of the module's deps, without any duplicates.
+func (m *Module) depLabels() []string {
+	labels := make([]string, 0, len(m.Deps))
+	for _, dep := range m.Deps {
+		labels = append(labels, dep.GetFullyQualifiedName())
+	}
+	return dedupe(labels)
+}
+
+// ruleDeps returns the labels of the module's deps, along with any extra deps from its config.
+func (m *Module) ruleDeps() []string {
+	return dedupe(append(m.depLabels(), m.configDeps()...))
+}
+
+// newRule returns a call to kind with just a name.
+func newRule(kind, name string) *build.Rule {
+	rule := build.NewRule(&build.CallExpr{X: &build.Ident{Name: kind}})
+	setString(rule, "name", name)
+	return rule
+}
+
+// setString sets the attribute to the string, leaving it out if it's empty.
+func setString(rule *build.Rule, key, value string) {
+	if value == "" {
+		return
+	}
+	rule.SetAttr(key, &build.StringExpr{Value: value})
+}
+
+// setStrings sets the attribute to the list of strings, leaving it out if it's empty. Lists
+// of more than one thing get a line each, like buildifier does with hand written lists.
+func setStrings(rule *build.Rule, key string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	list := &build.ListExpr{ForceMultiLine: len(values) > 1}
+	for _, value := range values {
+		list.List = append(list.List, &build.StringExpr{Value: value})
+	}
+	rule.SetAttr(key, list)
+}
+
+// formatRules prints the rules the way buildifier would, with the attributes in canonical
+// order, and sortable lists such as deps sorted. Each rule is separated by a blank line.
+func formatRules(rules []*build.Rule) []byte {
+	formatted := make([][]byte, 0, len(rules))
+	for _, rule := range rules {
+		f := &build.File{Type: build.TypeBuild, Stmt: []build.Expr{rule.Call}}
+		formatted = append(formatted, build.Format(f))
+	}
+	return bytes.Join(formatted, []byte("\n"))
+}
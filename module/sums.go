@@ -0,0 +1,85 @@
+package module
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// sumLabelPrefix and goModSumLabelPrefix prefix the labels we record the hashes of the
+	// module's zip and go.mod file in.
+	sumLabelPrefix      = "go_sum:"
+	goModSumLabelPrefix = "go_mod_sum:"
+)
+
+// AddGoSum adds the hashes from the go.sum file at path to the known hashes, which the
+// downloaded modules are checked against.
+func (d *Directory) AddGoSum(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read go.sum file: %w", err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: malformed go.sum line", path, line)
+		}
+		err := d.addSum(fields[0]+" "+fields[1], fields[2])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return nil
+}
+
+// addSum adds a known hash. The key is the module path and version separated by a space,
+// with /go.mod on the end of the version for the hash of the go.mod file, as in go.sum.
+func (d *Directory) addSum(key, sum string) error {
+	if existing, ok := d.sums[key]; ok && existing != sum {
+		return fmt.Errorf("conflicting hashes for %s: %s and %s", key, existing, sum)
+	}
+	d.sums[key] = sum
+	return nil
+}
+
+// addSumLabels adds the hashes recorded in the labels of an existing rule for the module.
+func (d *Directory) addSumLabels(path, version string, labels []string) error {
+	for _, label := range labels {
+		var err error
+		switch {
+		case strings.HasPrefix(label, sumLabelPrefix):
+			err = d.addSum(path+" "+version, strings.TrimPrefix(label, sumLabelPrefix))
+		case strings.HasPrefix(label, goModSumLabelPrefix):
+			err = d.addSum(path+" "+version+"/go.mod", strings.TrimPrefix(label, goModSumLabelPrefix))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the hashes of whatever has been downloaded of the module against the known
+// hashes, if we have any for it.
+func (d *Directory) verify(mod *Module) error {
+	key := mod.GetDownloadPath() + " " + mod.GetDownloadVersion()
+	if err := checkSum(key+"/go.mod", mod.GoModSum, d.sums); err != nil {
+		return err
+	}
+	return checkSum(key, mod.Sum, d.sums)
+}
+
+func checkSum(key, sum string, sums map[string]string) error {
+	want, ok := sums[key]
+	if !ok || sum == "" || sum == want {
+		return nil
+	}
+	return fmt.Errorf("checksum mismatch for %s:\n\tdownloaded: %s\n\texpected:   %s\nthe module may have been tampered with", key, sum, want)
+}
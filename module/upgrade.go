@@ -0,0 +1,152 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"text/tabwriter"
+
+	"golang.org/x/mod/semver"
+)
+
+// UpgradePolicy limits how far Upgrade moves a module from the version it is at.
+type UpgradePolicy int
+
+const (
+	// UpgradeLatest upgrades modules to their latest version.
+	UpgradeLatest UpgradePolicy = iota
+	// UpgradeMinor upgrades modules to the latest version with the same major version.
+	UpgradeMinor
+	// UpgradePatch upgrades modules to the latest version with the same major and minor version.
+	UpgradePatch
+)
+
+// allows returns whether the policy allows moving from the current version to version.
+func (p UpgradePolicy) allows(current, version string) bool {
+	switch p {
+	case UpgradeMinor:
+		return semver.Major(version) == semver.Major(current)
+	case UpgradePatch:
+		return semver.MajorMinor(version) == semver.MajorMinor(current)
+	}
+	return true
+}
+
+// Upgrade raises the minimum version of the modules already in the third party directory
+// with the given paths, or all of them if none are given, to the latest version the policy
+// allows. The new versions only take effect once the directory is resolved again, so that
+// the rest of the graph can follow them.
+func (d *Directory) Upgrade(ctx context.Context, policy UpgradePolicy, paths ...string) error {
+	if len(paths) == 0 {
+		for _, path := range d.paths() {
+			if d.modules[path].existingVersion() != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	// The candidates start off at the current versions, and the workers move them up.
+	candidates := make([]*Module, 0, len(paths))
+	for _, path := range paths {
+		vd := d.Get(path)
+		if vd == nil || vd.existingVersion() == "" {
+			return fmt.Errorf("%s isn't in the third party directory, add it instead", path)
+		}
+		current := vd.existing()
+		if current.replace != nil {
+			log.Printf("Not upgrading %s as it is replaced by %s\n", current.String(), current.replace.String())
+			continue
+		}
+		candidates = append(candidates, &Module{Path: path, Version: current.Version})
+	}
+
+	latest := func(ctx context.Context, mod *Module) error {
+		version, err := d.latestVersion(ctx, mod.Path, mod.Version, policy)
+		if err != nil {
+			return err
+		}
+		mod.Version = version
+		return nil
+	}
+	err := d.fetchAll(ctx, candidates, latest, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, mod := range candidates {
+		current := d.Get(mod.Path).existingVersion()
+		if mod.Version == current {
+			log.Printf("%s@%s is already the latest allowed version\n", mod.Path, current)
+			continue
+		}
+		d.upgrades = append(d.upgrades, d.SetModule(mod))
+	}
+	return nil
+}
+
+// latestVersion returns the latest version of the module the policy allows moving to from
+// the current version, or the current version if there is nothing newer. Pre-releases are
+// only picked if the module has no releases, as with go get -u.
+func (d *Directory) latestVersion(ctx context.Context, path, current string, policy UpgradePolicy) (string, error) {
+	versions, err := d.fetcher.List(ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to list versions of %s: %w", path, err)
+	}
+	if len(versions) == 0 {
+		if policy != UpgradeLatest {
+			// Without any tags, there's nothing to tell a patch from a new major version.
+			return current, nil
+		}
+		// The module has never been tagged, so the latest version is a pseudo-version.
+		resp, err := d.fetcher.DownloadGoMod(ctx, path, "latest")
+		if err != nil {
+			return "", err
+		}
+		versions = []string{resp.Version}
+	}
+
+	latest, latestPrerelease, released := current, current, false
+	for _, version := range versions {
+		if !semver.IsValid(version) || !policy.allows(current, version) || d.isExcluded(path, version) {
+			continue
+		}
+		if semver.Prerelease(version) != "" {
+			if semver.Compare(version, latestPrerelease) > 0 {
+				latestPrerelease = version
+			}
+			continue
+		}
+		released = true
+		if semver.Compare(version, latest) > 0 {
+			latest = version
+		}
+	}
+	if !released {
+		return latestPrerelease, nil
+	}
+	return latest, nil
+}
+
+// PrintVersionTable prints a table of the version of each module on disk before and after
+// writing the directory out.
+func (d *Directory) PrintVersionTable(w io.Writer) error {
+	changes := d.Changes()
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "Everything is up to date")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODULE\tBEFORE\tAFTER")
+	for _, change := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", change.Path, orDash(change.OldVersion), orDash(change.NewVersion))
+	}
+	return tw.Flush()
+}
+
+func orDash(version string) string {
+	if version == "" {
+		return "-"
+	}
+	return version
+}
@@ -0,0 +1,67 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// upgradeRepo has two modules on disk, with foo depending on bar.
+var upgradeRepo = map[string]string{
+	"third_party/go/example.com/BUILD": moduleRule("foo", "example.com/foo", "v1.0.0", ":bar") + "\n" +
+		moduleRule("bar", "example.com/bar", "v1.2.3"),
+}
+
+func TestUpgrade(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy UpgradePolicy
+		want   []string
+	}{
+		{name: "latest", policy: UpgradeLatest, want: []string{"example.com/bar@v2.0.0", "example.com/foo@v1.1.0"}},
+		{name: "minor", policy: UpgradeMinor, want: []string{"example.com/bar@v1.3.0", "example.com/foo@v1.1.0"}},
+		{name: "patch", policy: UpgradePatch, want: []string{"example.com/bar@v1.2.4", "example.com/foo@v1.0.1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := newFakeFetcher()
+			fetcher.versions["example.com/foo"] = []string{"v1.0.0", "v1.0.1", "v1.1.0", "v1.2.0-rc1"}
+			fetcher.versions["example.com/bar"] = []string{"v1.2.3", "v1.2.4", "v1.3.0", "v2.0.0"}
+			d := loadRepo(t, fetcher, upgradeRepo)
+
+			if err := d.Upgrade(context.Background(), test.policy); err != nil {
+				t.Fatalf("Upgrade() failed: %v", err)
+			}
+			got := []string{}
+			for _, mod := range d.upgrades {
+				got = append(got, mod.String())
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("Upgrade() picked %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeMissingFromProxy(t *testing.T) {
+	errGone := errors.New("not found: example.com/bar has been deleted")
+	fetcher := newFakeFetcher()
+	fetcher.versions["example.com/foo"] = []string{"v1.1.0"}
+	fetcher.fail["example.com/bar"] = errGone
+	d := loadRepo(t, fetcher, upgradeRepo)
+
+	err := d.Upgrade(context.Background(), UpgradeLatest)
+	if !errors.Is(err, errGone) || !strings.Contains(err.Error(), "failed to list versions of example.com/bar") {
+		t.Errorf("Upgrade() error = %v, want it to fail listing example.com/bar", err)
+	}
+}
+
+func TestUpgradeNotInThirdParty(t *testing.T) {
+	d := loadRepo(t, newFakeFetcher(), upgradeRepo)
+
+	err := d.Upgrade(context.Background(), UpgradeLatest, "example.com/baz")
+	if err == nil || !strings.Contains(err.Error(), "example.com/baz isn't in the third party directory") {
+		t.Errorf("Upgrade() error = %v, want example.com/baz to be missing", err)
+	}
+}
@@ -0,0 +1,185 @@
+package module
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// Explanation is why a module is needed, and why it is at the version it's at.
+type Explanation struct {
+	Path string
+	// Version is the selected version of the module.
+	Version string
+	// Chains are the shortest chains of dependencies from each of the roots that needs the
+	// module to the module, shortest first.
+	Chains [][]string
+	// Requirements are the versions of the module that were asked for, and what asked for
+	// them, in semver order. The highest of these is the one that was selected.
+	Requirements []VersionRequirement
+}
+
+// VersionRequirement is a version of a module, and the module versions that require it. Those
+// that were inferred from the requirer's imports are marked (inferred).
+type VersionRequirement struct {
+	Version    string
+	RequiredBy []string
+	Selected   bool
+}
+
+// Why explains why the module with the given path is needed after resolving, by finding
+// the shortest chains of dependencies to it from the roots, and what required each of the
+// versions Minimal Version Selection had to pick between.
+func (d *Directory) Why(path string) (*Explanation, error) {
+	mod := d.GetSelected(path)
+	if mod == nil {
+		return nil, fmt.Errorf("%s isn't in the build list", path)
+	}
+	explanation := &Explanation{
+		Path:    mod.Path,
+		Version: mod.Version,
+		Chains:  d.chainsTo(mod),
+	}
+
+	requiredBy := map[string][]string{}
+	for _, target := range d.targets() {
+		if target.Path == path {
+			requiredBy[target.Version] = append(requiredBy[target.Version], d.targetReason(target))
+		}
+	}
+	for _, p := range d.paths() {
+		vd := d.modules[p]
+		for _, version := range vd.Versions() {
+			requirer := vd.versions[version]
+			if req, ok := requirer.requirement(path); ok && requirer.Path != path {
+				reason := requirer.String()
+				if req.Inferred {
+					reason += " (inferred)"
+				}
+				requiredBy[req.Version] = append(requiredBy[req.Version], reason)
+			}
+		}
+	}
+	for version, requirers := range requiredBy {
+		explanation.Requirements = append(explanation.Requirements, VersionRequirement{
+			Version:    version,
+			RequiredBy: dedupe(requirers),
+			Selected:   version == mod.Version,
+		})
+	}
+	sort.Slice(explanation.Requirements, func(i, j int) bool {
+		return semver.Compare(explanation.Requirements[i].Version, explanation.Requirements[j].Version) < 0
+	})
+	return explanation, nil
+}
+
+// targetReason describes why a target is one.
+func (d *Directory) targetReason(target *Module) string {
+	for _, root := range d.roots {
+		if root == target {
+			return "(root)"
+		}
+	}
+	for _, upgrade := range d.upgrades {
+		if upgrade == target {
+			return "(upgrade)"
+		}
+	}
+	return "(existing rule)"
+}
+
+// chainsTo returns the shortest chain of dependencies from each root that depends on the
+// module, sorted by length.
+func (d *Directory) chainsTo(mod *Module) [][]string {
+	seen := map[*Module]struct{}{}
+	chains := [][]string{}
+	for _, root := range d.Roots() {
+		start := d.GetSelected(root.Path)
+		if start == nil {
+			continue
+		}
+		if _, ok := seen[start]; ok {
+			continue
+		}
+		seen[start] = struct{}{}
+		if chain := shortestChain(start, mod); chain != nil {
+			chains = append(chains, chain)
+		}
+	}
+	sort.SliceStable(chains, func(i, j int) bool {
+		if len(chains[i]) != len(chains[j]) {
+			return len(chains[i]) < len(chains[j])
+		}
+		return strings.Join(chains[i], " ") < strings.Join(chains[j], " ")
+	})
+	return chains
+}
+
+// shortestChain does a breadth first search of the deps from start to mod, returning the
+// modules along the way, or nil if mod can't be reached.
+func shortestChain(start, mod *Module) []string {
+	parents := map[*Module]*Module{start: nil}
+	queue := []*Module{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == mod {
+			chain := []string{}
+			for m := current; m != nil; m = parents[m] {
+				chain = append([]string{m.String()}, chain...)
+			}
+			return chain
+		}
+		for _, dep := range current.Deps {
+			if _, ok := parents[dep]; !ok {
+				parents[dep] = current
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return nil
+}
+
+// Print prints the explanation in a readable form.
+func (e *Explanation) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s@%s\n", e.Path, e.Version)
+	if len(e.Chains) == 0 {
+		fmt.Fprintln(w, "Not needed by any of the roots, it is only used to select versions")
+	} else {
+		fmt.Fprintln(w, "Needed by:")
+		for _, chain := range e.Chains {
+			fmt.Fprintf(w, "\t%s\n", strings.Join(chain, " --> "))
+		}
+	}
+	// Show what forced the selected version first, and then what it won out over.
+	for _, selected := range []bool{true, false} {
+		for _, req := range e.Requirements {
+			if req.Selected != selected {
+				continue
+			}
+			if selected {
+				fmt.Fprintf(w, "Selected %s, as required by:\n", req.Version)
+			} else {
+				fmt.Fprintf(w, "Over %s, as required by:\n", req.Version)
+			}
+			for _, requirer := range req.RequiredBy {
+				fmt.Fprintf(w, "\t%s\n", requirer)
+			}
+		}
+	}
+}
+
+// dedupe sorts the strings and removes any duplicates.
+func dedupe(strs []string) []string {
+	sort.Strings(strs)
+	out := strs[:0]
+	for i, s := range strs {
+		if i == 0 || s != strs[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
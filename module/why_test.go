@@ -0,0 +1,58 @@
+package module
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// whyGraph has c asking for a newer b than a does, and nothing needing d@v1.0.0.
+var whyGraph = graph{
+	"a@v1.0.0": {"b@v1.0.0", "c@v1.0.0"},
+	"c@v1.0.0": {"b@v1.1.0"},
+	"b@v1.0.0": {"d@v1.0.0"},
+}
+
+func TestWhy(t *testing.T) {
+	d := resolveGraph(t, whyGraph, "a@v1.0.0")
+
+	explanation, err := d.Why("b")
+	if err != nil {
+		t.Fatalf("Why() failed: %v", err)
+	}
+	want := &Explanation{
+		Path:    "b",
+		Version: "v1.1.0",
+		Chains:  [][]string{{"a@v1.0.0", "b@v1.1.0"}},
+		Requirements: []VersionRequirement{
+			{Version: "v1.0.0", RequiredBy: []string{"a@v1.0.0"}},
+			{Version: "v1.1.0", RequiredBy: []string{"c@v1.0.0"}, Selected: true},
+		},
+	}
+	if !reflect.DeepEqual(explanation, want) {
+		t.Errorf("Why() = %+v, want %+v", explanation, want)
+	}
+}
+
+func TestWhyOnlyUsedToSelectVersions(t *testing.T) {
+	d := resolveGraph(t, whyGraph, "a@v1.0.0")
+
+	explanation, err := d.Why("d")
+	if err != nil {
+		t.Fatalf("Why() failed: %v", err)
+	}
+	var out strings.Builder
+	explanation.Print(&out)
+	if !strings.Contains(out.String(), "Not needed by any of the roots") || !strings.Contains(out.String(), "\tb@v1.0.0\n") {
+		t.Errorf("Print() = %q, want d to only be required by the old b", out.String())
+	}
+}
+
+func TestWhyNotInGraph(t *testing.T) {
+	d := resolveGraph(t, whyGraph, "a@v1.0.0")
+
+	_, err := d.Why("example.com/missing")
+	if err == nil || !strings.Contains(err.Error(), "example.com/missing isn't in the build list") {
+		t.Errorf("Why() error = %v, want example.com/missing not to be in the build list", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Package plzconfig reads the bits of a repo's Please config that go-deps cares about.
+//
+// Please config files are ini style, with [section] headers and key = value pairs. Keys and
+// section names are case insensitive, and later files override earlier ones, in the same
+// order Please reads them in: .plzconfig, then .plzconfig_<os>_<arch>, then .plzconfig.<profile>
+// for each profile, and finally .plzconfig.local.
+package plzconfig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// FileName is the name of the main config file, which marks the root of the repo.
+	FileName = ".plzconfig"
+	// DefaultThirdPartyDir is where third party rules go if the config doesn't say otherwise.
+	DefaultThirdPartyDir = "third_party/go"
+	// thirdPartyDirKey is the key in the [buildconfig] section that sets the third party
+	// directory. Please lets anything go in there, so it won't complain about it.
+	thirdPartyDirKey = "go-deps-third-party-dir"
+	// layoutKey is the key in the [buildconfig] section that sets the layout of the third
+	// party directory.
+	layoutKey = "go-deps-layout"
+	// rulesKey is the key in the [buildconfig] section that sets the rules to generate.
+	rulesKey = "go-deps-rules"
+	// platformKey is the key in the [buildconfig] section that sets the platform packages are
+	// scanned for.
+	platformKey = "go-deps-platform"
+)
+
+// Config is the config of the repo.
+type Config struct {
+	// Root is the root of the repo, the directory containing .plzconfig.
+	Root string
+	// GoTool is the go tool from [go] gotool, if set.
+	GoTool string
+	// ImportPath is the import path of the repo, from [go] importpath.
+	ImportPath string
+	// ThirdPartyDir is the third party directory, relative to Root.
+	ThirdPartyDir string
+	// Layout is the layout of the BUILD files in the third party directory, if set.
+	Layout string
+	// Rules is the kind of rules to generate for modules, if set.
+	Rules string
+	// Platform is the platform to scan packages for, in os_arch form, if set.
+	Platform string
+}
+
+// FindRoot walks up from dir until it finds a .plzconfig, returning the directory it's in.
+func FindRoot(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, FileName)); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Load finds the root of the repo containing dir, and reads its config files, including
+// the overlays for each of the profiles. If dir isn't in a Please repo, dir is used as the
+// root, and everything is left as the default.
+func Load(dir string, profiles ...string) (*Config, error) {
+	root, ok := FindRoot(dir)
+	config := &Config{
+		Root:          root,
+		ThirdPartyDir: DefaultThirdPartyDir,
+	}
+	if !ok {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the repo root: %w", err)
+		}
+		config.Root = abs
+		return config, nil
+	}
+
+	files := []string{FileName, FileName + "_" + runtime.GOOS + "_" + runtime.GOARCH}
+	for _, profile := range profiles {
+		files = append(files, FileName+"."+profile)
+	}
+	files = append(files, FileName+".local")
+
+	values := map[string]string{}
+	for _, file := range files {
+		err := readFile(filepath.Join(root, file), values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if goTool, ok := values["go.gotool"]; ok {
+		config.GoTool = goTool
+	}
+	if importPath, ok := values["go.importpath"]; ok {
+		config.ImportPath = importPath
+	}
+	if thirdParty, ok := values["buildconfig."+thirdPartyDirKey]; ok {
+		config.ThirdPartyDir = filepath.Clean(strings.TrimPrefix(thirdParty, "//"))
+	}
+	if layout, ok := values["buildconfig."+layoutKey]; ok {
+		config.Layout = layout
+	}
+	if rules, ok := values["buildconfig."+rulesKey]; ok {
+		config.Rules = rules
+	}
+	if platform, ok := values["buildconfig."+platformKey]; ok {
+		config.Platform = platform
+	}
+	return config, nil
+}
+
+// readFile reads the config file at path into values, keyed by section.key, in lower case.
+// Files that don't exist are skipped.
+func readFile(path string, values map[string]string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "["):
+			if !strings.HasSuffix(text, "]") {
+				return fmt.Errorf("%s:%d: malformed section header", path, line)
+			}
+			// Subsections like [plugin "go"] are kept as plugin "go".
+			section = strings.ToLower(strings.TrimSpace(text[1 : len(text)-1]))
+		default:
+			i := strings.Index(text, "=")
+			if i < 0 {
+				return fmt.Errorf("%s:%d: expected key = value", path, line)
+			}
+			key := strings.ToLower(strings.TrimSpace(text[:i]))
+			values[section+"."+key] = strings.Trim(strings.TrimSpace(text[i+1:]), `"`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	return nil
+}
+
+// stripComment removes a ; or # comment from the line, as long as it isn't in quotes.
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ';', '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// GoToolPath returns the go tool to run, if the configured one is something we can run.
+// Please lets gotool be a build label, such as the output of a go_toolchain rule, which we
+// can only use if it has already been built.
+func (c *Config) GoToolPath() (string, bool) {
+	goTool := c.GoTool
+	if goTool == "" {
+		return "", false
+	}
+	if !strings.HasPrefix(goTool, "//") && !strings.HasPrefix(goTool, ":") {
+		if strings.Contains(goTool, "/") && !filepath.IsAbs(goTool) {
+			goTool = filepath.Join(c.Root, goTool)
+		}
+		return goTool, true
+	}
+
+	// Labels like //third_party/go:toolchain|go name an entry point of the rule's output,
+	// which ends up in bin/ under the rule's directory in plz-out/gen.
+	label, entry := goTool, "go"
+	if i := strings.Index(label, "|"); i >= 0 {
+		label, entry = label[:i], label[i+1:]
+	}
+	pkg, name := strings.TrimPrefix(label, "//"), ""
+	if i := strings.Index(pkg, ":"); i >= 0 {
+		pkg, name = pkg[:i], pkg[i+1:]
+	}
+	if name == "" {
+		name = filepath.Base(pkg)
+	}
+	built := filepath.Join(c.Root, "plz-out", "gen", filepath.FromSlash(pkg), name, "bin", entry)
+	if _, err := os.Stat(built); err != nil {
+		return "", false
+	}
+	return built, true
+}